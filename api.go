@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	API_ROOT           = "/goslow" // reserved on the admin domain, so sites can have their own /api/v1/ endpoints
+	API_PATH_PREFIX    = "/api/v1/"
+	ENDPOINTS_API_PATH = API_PATH_PREFIX + "endpoints"
+)
+
+// EndpointResource is the JSON representation of an endpoint in the API.
+// Id is made from the path, method and predicates of the endpoint, so it changes when they change.
+// Response is a string (unlike other []byte fields that are base64 encoded), durations are in nanoseconds.
+type EndpointResource struct {
+	Id string
+	*Endpoint
+	Response string
+}
+
+func newEndpointResource(endpoint *Endpoint) *EndpointResource {
+	return &EndpointResource{Id: endpointId(endpoint), Endpoint: endpoint, Response: string(endpoint.Response)}
+}
+
+func newEndpointResources(endpoints []*Endpoint) []*EndpointResource {
+	resources := make([]*EndpointResource, 0)
+	for _, endpoint := range endpoints {
+		resources = append(resources, newEndpointResource(endpoint))
+	}
+	return resources
+}
+
+// endpointKey has the same fields as the primary key in the endpoints table (except for the site).
+type endpointKey struct {
+	Path       string
+	Method     string
+	Predicates []*Predicate
+}
+
+func endpointId(endpoint *Endpoint) string {
+	key, _ := json.Marshal(&endpointKey{Path: endpoint.Path, Method: endpoint.Method, Predicates: endpoint.Predicates})
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// parseEndpointId returns the endpoint with only the primary key fields set.
+func parseEndpointId(site, id string) (*Endpoint, error) {
+	rawKey, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, UnknownEndpointError(id)
+	}
+	key := &endpointKey{}
+	err = json.Unmarshal(rawKey, key)
+	if err != nil {
+		return nil, UnknownEndpointError(id)
+	}
+	if key.Predicates == nil {
+		key.Predicates = make([]*Predicate, 0)
+	}
+	return &Endpoint{Site: site, Path: key.Path, Method: key.Method, Predicates: key.Predicates}, nil
+}
+
+// Server.isApi checks for requests to the API, which accepts any method.
+func (server *Server) isApi(req *http.Request) bool {
+	return server.isAdminDomain(req) && strings.HasPrefix(req.URL.Path, server.getApiRoot()+API_PATH_PREFIX)
+}
+
+// Server.getApiRoot returns the path the API lives under: /goslow on the admin domain,
+// or the admin path prefix in the single site mode, so it's /goslow/api/v1/ by default in both modes.
+func (server *Server) getApiRoot() string {
+	if server.isInSingleSiteMode() {
+		return strings.TrimSuffix(server.config.adminPathPrefix, "/")
+	}
+	return API_ROOT
+}
+
+// Server.handleApi serves:
+// GET    /goslow/api/v1/endpoints       list endpoints of the site
+// POST   /goslow/api/v1/endpoints       create an endpoint, 409 if it exists
+// GET    /goslow/api/v1/endpoints/ID    get an endpoint
+// PUT    /goslow/api/v1/endpoints/ID    replace an endpoint, its path, method and predicates can be changed too
+// DELETE /goslow/api/v1/endpoints/ID    delete an endpoint
+// Errors are JSON ApiErrors.
+func (server *Server) handleApi(w http.ResponseWriter, req *http.Request) {
+	err := server.serveApi(w, req)
+	if err != nil {
+		server.handleApiError(err, w)
+	}
+}
+
+func (server *Server) serveApi(w http.ResponseWriter, req *http.Request) error {
+	endpointsPath := server.getApiRoot() + ENDPOINTS_API_PATH
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	id := ""
+	if path != endpointsPath {
+		if !strings.HasPrefix(path, endpointsPath+"/") {
+			return UnknownApiPathError(path, endpointsPath)
+		}
+		id = strings.TrimPrefix(path, endpointsPath+"/")
+	}
+	site := server.getSite(req)
+	if !canChange(site) {
+		return CantChangeBuiltinSiteError()
+	}
+	siteExists, err := server.storage.SiteExists(site)
+	if err != nil {
+		return err
+	}
+	if !siteExists {
+		return UnknownSiteError(site)
+	}
+	switch {
+	case id == "" && req.Method == "GET":
+		return server.listEndpointResources(w, site)
+	case id == "" && req.Method == "POST":
+		return server.createEndpointResource(w, site, req, endpointsPath)
+	case id != "" && req.Method == "GET":
+		return server.getEndpointResource(w, site, id)
+	case id != "" && req.Method == "PUT":
+		return server.updateEndpointResource(w, site, id, req)
+	case id != "" && req.Method == "DELETE":
+		return server.deleteEndpointResource(w, site, id)
+	}
+	return MethodNotAllowedError(req.Method, path)
+}
+
+func (server *Server) listEndpointResources(w http.ResponseWriter, site string) error {
+	endpoints, err := server.storage.GetEndpoints(site)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newEndpointResources(endpoints))
+}
+
+func (server *Server) createEndpointResource(w http.ResponseWriter, site string, req *http.Request,
+	endpointsPath string) error {
+	endpoint, err := decodeEndpoint(site, req)
+	if err != nil {
+		return err
+	}
+	_, exists, err := server.storage.GetEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return EndpointExistsError(endpoint)
+	}
+	err = server.saveEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	resource := newEndpointResource(endpoint)
+	w.Header().Set("Location", endpointsPath+"/"+resource.Id)
+	return writeJson(w, http.StatusCreated, resource)
+}
+
+func (server *Server) getEndpointResource(w http.ResponseWriter, site, id string) error {
+	endpoint, err := server.findEndpointById(site, id)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newEndpointResource(endpoint))
+}
+
+func (server *Server) updateEndpointResource(w http.ResponseWriter, site, id string, req *http.Request) error {
+	old, err := server.findEndpointById(site, id)
+	if err != nil {
+		return err
+	}
+	endpoint, err := decodeEndpoint(site, req)
+	if err != nil {
+		return err
+	}
+	if endpointId(endpoint) != id {
+		_, exists, err := server.storage.GetEndpoint(endpoint)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return EndpointExistsError(endpoint)
+		}
+		_, err = server.deleteEndpoint(old)
+		if err != nil {
+			return err
+		}
+	}
+	err = server.saveEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, newEndpointResource(endpoint))
+}
+
+func (server *Server) deleteEndpointResource(w http.ResponseWriter, site, id string) error {
+	endpoint, err := parseEndpointId(site, id)
+	if err != nil {
+		return err
+	}
+	deleted, err := server.deleteEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return UnknownEndpointError(id)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (server *Server) findEndpointById(site, id string) (*Endpoint, error) {
+	key, err := parseEndpointId(site, id)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, found, err := server.storage.GetEndpoint(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, UnknownEndpointError(id)
+	}
+	return endpoint, nil
+}
+
+// decodeEndpoint reads EndpointResource from the request body, missing fields have the same defaults
+// as missing query params when an endpoint is created by POST to the admin domain.
+func decodeEndpoint(site string, req *http.Request) (*Endpoint, error) {
+	endpoint := &Endpoint{StatusCode: DEFAULT_STATUS_CODE, Weight: DEFAULT_WEIGHT, StallOffset: -1}
+	resource := &EndpointResource{Endpoint: endpoint}
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(resource)
+	if err != nil {
+		return nil, InvalidEndpointJsonError(err)
+	}
+	endpoint.Site = site
+	endpoint.Response = []byte(resource.Response)
+	if endpoint.StallOffset == -1 {
+		// same as getStallOffset
+		endpoint.StallOffset = len(endpoint.Response) / 2
+	}
+	err = endpoint.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+// Endpoint.normalize validates the endpoint decoded from JSON with the same parsers
+// that are used for query params, so both ways lead to the same endpoints.
+func (endpoint *Endpoint) normalize() error {
+	if endpoint.PathIsRegexp {
+		_, err := compileRegexp(endpoint.Path)
+		if err != nil {
+			return InvalidPathRegexpError(endpoint.Path, err)
+		}
+	} else {
+		err := checkGlob(endpoint.Path)
+		if err != nil {
+			return err
+		}
+	}
+	predicates := make([]*Predicate, 0)
+	for _, predicate := range endpoint.Predicates {
+		if predicate == nil {
+			return NullElementError("Predicates")
+		}
+		normalized, err := normalizePredicate(predicate)
+		if err != nil {
+			return err
+		}
+		predicates = append(predicates, normalized)
+	}
+	sortPredicates(predicates)
+	endpoint.Predicates = predicates
+	if endpoint.Headers == nil {
+		endpoint.Headers = make(http.Header)
+	}
+	for _, delay := range []time.Duration{endpoint.Delay, endpoint.BodyDelay, endpoint.StallDelay} {
+		_, err := parseDelayValue(delay.String())
+		if err != nil {
+			return err
+		}
+	}
+	if endpoint.DelayDistribution != nil {
+		_, distribution, err := parseDelay(endpoint.DelayDistribution.String())
+		if err != nil {
+			return err
+		}
+		endpoint.DelayDistribution = distribution
+	}
+	err := checkStatusCode(endpoint.StatusCode)
+	if err != nil {
+		return err
+	}
+	if endpoint.BytesPerSecond < 0 {
+		return NegativeIntError("BytesPerSecond", strconv.Itoa(endpoint.BytesPerSecond))
+	}
+	if endpoint.ChunkSize < 0 {
+		return NegativeIntError("ChunkSize", strconv.Itoa(endpoint.ChunkSize))
+	}
+	if endpoint.StallOffset < 0 || endpoint.StallOffset > len(endpoint.Response) {
+		return InvalidStallOffsetError(strconv.Itoa(endpoint.StallOffset), len(endpoint.Response))
+	}
+	if endpoint.Fault != NO_FAULT && !isFault(endpoint.Fault) {
+		return UnknownFaultError(endpoint.Fault)
+	}
+	if endpoint.Weight < 0 {
+		return InvalidWeightError(strconv.Itoa(endpoint.Weight))
+	}
+	if endpoint.Variants == nil {
+		endpoint.Variants = make([]*Variant, 0)
+	}
+	if endpoint.Sequence == nil {
+		endpoint.Sequence = make([]*Variant, 0)
+	}
+	err = checkNoNullVariants("Variants", endpoint.Variants)
+	if err != nil {
+		return err
+	}
+	err = checkNoNullVariants("Sequence", endpoint.Sequence)
+	if err != nil {
+		return err
+	}
+	variants := append(append([]*Variant{}, endpoint.Variants...), endpoint.Sequence...)
+	if endpoint.RateLimit != nil {
+		limit := endpoint.RateLimit
+		rawRateLimit := fmt.Sprintf("%d%s%s", limit.Requests, RATE_LIMIT_SEPARATOR, limit.Interval)
+		endpoint.RateLimit, err = parseRateLimit(rawRateLimit, limit.Key, limit.Response)
+		if err != nil {
+			return err
+		}
+	}
+	if endpoint.Outage != nil {
+		for _, window := range endpoint.Outage.Windows {
+			if window == nil {
+				return NullElementError("Outage.Windows")
+			}
+			_, err := parseOutageWindow(fmt.Sprintf("%s%s%s%s%s", window.Length, OUTAGE_PERIOD_SEPARATOR,
+				window.Period, OUTAGE_OFFSET_SEPARATOR, window.Offset))
+			if err != nil {
+				return err
+			}
+		}
+		if endpoint.Outage.Response == nil {
+			endpoint.Outage.Response = &Variant{StatusCode: http.StatusServiceUnavailable}
+		}
+		variants = append(variants, endpoint.Outage.Response)
+	}
+	for _, variant := range variants {
+		if variant.Weight < 0 {
+			return InvalidWeightError(strconv.Itoa(variant.Weight))
+		}
+		err := checkStatusCode(variant.StatusCode)
+		if err != nil {
+			return err
+		}
+		if variant.Fault != NO_FAULT && !isFault(variant.Fault) {
+			return UnknownFaultError(variant.Fault)
+		}
+	}
+	if endpoint.Mode != STATIC_MODE && !isMode(endpoint.Mode) {
+		return UnknownModeError(endpoint.Mode)
+	}
+	if endpoint.Mode == TEMPLATE_MODE {
+		return endpoint.checkResponseTemplates()
+	}
+	return nil
+}
+
+// checkNoNullVariants rejects nil variants, JSON null decodes to them.
+func checkNoNullVariants(field string, variants []*Variant) error {
+	for _, variant := range variants {
+		if variant == nil {
+			return NullElementError(field)
+		}
+	}
+	return nil
+}
+
+// normalizePredicate makes a predicate from its raw form, see parsePredicate and parseBodyPredicate.
+func normalizePredicate(predicate *Predicate) (*Predicate, error) {
+	switch {
+	case predicate.Source == QUERY_PREDICATE || predicate.Source == HEADER_PREDICATE:
+		switch predicate.Kind {
+		case PRESENT_PREDICATE:
+			return parsePredicate(predicate.Source, predicate.Name)
+		case EQUALS_PREDICATE:
+			return parsePredicate(predicate.Source, predicate.Name+EQUALS_SEPARATOR+predicate.Value)
+		case REGEXP_PREDICATE:
+			return parsePredicate(predicate.Source, predicate.Name+REGEXP_SEPARATOR+predicate.Value)
+		case EMPTY_PREDICATE:
+			if predicate.Source == QUERY_PREDICATE {
+				return &Predicate{Source: QUERY_PREDICATE, Kind: EMPTY_PREDICATE}, nil
+			}
+		}
+	case predicate.Source == BODY_PREDICATE:
+		switch predicate.Kind {
+		case EQUALS_PREDICATE, CONTAINS_PREDICATE, REGEXP_PREDICATE:
+			return parseBodyPredicate(predicate.Kind, predicate.Value)
+		case JSON_EQUALS_PREDICATE:
+			return parseBodyPredicate(predicate.Kind, predicate.Name+JSON_EQUALS_SEPARATOR+predicate.Value)
+		}
+	}
+	return nil, InvalidPredicateError(predicate.String(), "unknown source or kind")
+}
+
+func checkStatusCode(statusCode int) error {
+	if statusCode < 100 || statusCode > 999 {
+		return InvalidStatusCodeError(strconv.Itoa(statusCode))
+	}
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, statusCode int, value interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// Server.handleApiError is like handleError, but responds with JSON ApiError.
+func (server *Server) handleApiError(err error, w http.ResponseWriter) {
+	log.Printf("error: %s", err)
+	apiError, isApiError := err.(*ApiError)
+	if !isApiError {
+		apiError = &ApiError{Message: fmt.Sprintf("Internal error: %s.", err), StatusCode: http.StatusInternalServerError}
+	}
+	writeJson(w, apiError.StatusCode, apiError)
+}
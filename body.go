@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// bufferedBody is an in-memory copy of the request body.
+// It's read from the network once and then can be read any number of times.
+type bufferedBody struct {
+	*bytes.Reader
+	content []byte
+
+	jsonParsed bool
+	json       interface{}
+	jsonErr    error
+}
+
+func (body *bufferedBody) Close() error {
+	return nil
+}
+
+// peekBody returns the request body without consuming it:
+// req.Body is replaced with the in-memory copy, so it can be read again later.
+func peekBody(req *http.Request) ([]byte, error) {
+	body, err := bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	return body.content, nil
+}
+
+// peekJSON returns the request body decoded as JSON, body is decoded only once.
+func peekJSON(req *http.Request) (interface{}, error) {
+	body, err := bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if !body.jsonParsed {
+		body.jsonErr = json.Unmarshal(body.content, &body.json)
+		body.jsonParsed = true
+	}
+	return body.json, body.jsonErr
+}
+
+func bufferBody(req *http.Request) (*bufferedBody, error) {
+	body, isBuffered := req.Body.(*bufferedBody)
+	if isBuffered {
+		body.Seek(0, 0) // rewind in case someone has read it
+		return body, nil
+	}
+	var content []byte
+	if req.Body != nil {
+		var err error
+		content, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	body = &bufferedBody{Reader: bytes.NewReader(content), content: content}
+	req.Body = body
+	return body, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const BUNDLE_VERSION = 1
+
+// CLI subcommands.
+const (
+	EXPORT_COMMAND = "export" // goslow [OPTIONS] export [SITE] > bundle.json
+	IMPORT_COMMAND = "import" // goslow [OPTIONS] import [--replace] [SITE] < bundle.json
+)
+
+// SiteBundle is a site with all its endpoints, responses are base64 encoded.
+type SiteBundle struct {
+	Version   int         `json:"version"`
+	Site      string      `json:"site"`
+	Endpoints []*Endpoint `json:"endpoints"`
+}
+
+func exportSite(storage *Storage, site string) (*SiteBundle, error) {
+	siteExists, err := storage.SiteExists(site)
+	if err != nil {
+		return nil, err
+	}
+	if !siteExists {
+		return nil, UnknownSiteError(site)
+	}
+	endpoints, err := storage.GetEndpoints(site)
+	if err != nil {
+		return nil, err
+	}
+	return &SiteBundle{Version: BUNDLE_VERSION, Site: site, Endpoints: endpoints}, nil
+}
+
+// decodeBundle validates endpoints of the bundle the same way as endpoints of the API.
+func decodeBundle(reader io.Reader) (*SiteBundle, error) {
+	bundle := &SiteBundle{}
+	err := json.NewDecoder(reader).Decode(bundle)
+	if err != nil {
+		return nil, InvalidBundleError(err.Error())
+	}
+	if bundle.Version != BUNDLE_VERSION {
+		return nil, InvalidBundleError(fmt.Sprintf("unsupported version %d", bundle.Version))
+	}
+	for i, endpoint := range bundle.Endpoints {
+		if endpoint == nil {
+			return nil, InvalidBundleError(fmt.Sprintf("endpoints[%d] is null", i))
+		}
+		err = endpoint.normalize()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bundle, nil
+}
+
+func (bundle *SiteBundle) moveTo(site string) {
+	bundle.Site = site
+	for _, endpoint := range bundle.Endpoints {
+		endpoint.Site = site
+	}
+}
+
+// Server.exportSite responds with the JSON SiteBundle.
+func (server *Server) exportSite(w http.ResponseWriter, site string) error {
+	bundle, err := exportSite(server.storage, site)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, bundle)
+}
+
+// Server.importBundle saves endpoints of the bundle from the request body to the site.
+// Existing endpoints are kept (unless they have the same path, method and predicates),
+// replace=true deletes them.
+func (server *Server) importBundle(site string, req *http.Request) (*SiteBundle, error) {
+	replace, err := getBoolParam(req.URL.Query(), REPLACE_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := decodeBundle(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = server.saveBundle(site, bundle, replace)
+	if err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// Server.saveBundle saves endpoints of the bundle to the site in a single transaction.
+func (server *Server) saveBundle(site string, bundle *SiteBundle, replace bool) error {
+	bundle.moveTo(site)
+	forgotten := bundle.Endpoints
+	if replace {
+		existing, err := server.storage.GetEndpoints(site)
+		if err != nil {
+			return err
+		}
+		forgotten = append(forgotten, existing...)
+	}
+	err := server.storage.ImportEndpoints(site, bundle.Endpoints, replace)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range forgotten {
+		server.forget(endpoint)
+	}
+	return nil
+}
+
+func (server *Server) showImportedBundle(w http.ResponseWriter, site string, bundle *SiteBundle) {
+	data := server.makeTemplateData(&Endpoint{Site: site})
+	data.Count = len(bundle.Endpoints)
+	BANNER_TEMPLATE.Execute(w, nil)
+	BUNDLE_IMPORTED_TEMPLATE.Execute(w, data)
+}
+
+// runSubcommand runs CLI subcommands against the storage of the config, so sites can be moved
+// between databases without running a server. Empty SITE means the single site,
+// import defaults to the site of the bundle.
+func runSubcommand(config *Config, args []string, stdin io.Reader, stdout io.Writer) error {
+	if config.isInMemory() {
+		return fmt.Errorf("command <%s> needs a persistent database, e.g --data-source /path/to/goslow.db", args[0])
+	}
+	storage, err := NewStorage(config.driver, config.dataSource)
+	if err != nil {
+		return err
+	}
+	defer storage.db.Close()
+	switch args[0] {
+	case EXPORT_COMMAND:
+		site := EMPTY_SITE
+		if len(args) > 1 {
+			site = args[1]
+		}
+		bundle, err := exportSite(storage, site)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(bundle)
+	case IMPORT_COMMAND:
+		flags := flag.NewFlagSet(IMPORT_COMMAND, flag.ContinueOnError)
+		replace := flags.Bool(REPLACE_PARAM, false, "delete endpoints of the site that aren't in the bundle")
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		bundle, err := decodeBundle(stdin)
+		if err != nil {
+			return err
+		}
+		if flags.NArg() > 0 {
+			bundle.moveTo(flags.Arg(0))
+		} else {
+			bundle.moveTo(bundle.Site)
+		}
+		err = storage.ImportEndpoints(bundle.Site, bundle.Endpoints, *replace)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "imported %d endpoints to site <%s>\n", len(bundle.Endpoints), bundle.Site)
+		return nil
+	case OPENAPI_COMMAND:
+		return runOpenApiSubcommand(storage, args[1:], stdin, stdout)
+	}
+	return fmt.Errorf("unknown command <%s>, expecting %s, %s, or %s", args[0], EXPORT_COMMAND, IMPORT_COMMAND,
+		OPENAPI_COMMAND)
+}
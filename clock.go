@@ -0,0 +1,14 @@
+package main
+
+import "time"
+
+// Clock is the source of the current time for schedules and rate limits, tests replace it with a fake one.
+type Clock interface {
+	Now() time.Time
+}
+
+var SYSTEM_CLOCK Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
 )
 
 // Config stores command line arguments.
@@ -15,6 +16,12 @@ type Config struct {
 	siteSalt               string
 	createDefaultEndpoints bool
 	adminPathPrefix        string
+	maxLoggedRequests      int // per site, 0 turns off the request log
+	allowProxy             bool
+	allowPrivateUpstreams  bool // loopback, private, link-local and unspecified addresses, see isPrivateIP
+	configFile             string
+	watchConfigFile        bool
+	args                   []string // subcommand with its arguments, see runSubcommand
 }
 
 var DEFAULT_CONFIG = Config{
@@ -28,6 +35,11 @@ var DEFAULT_CONFIG = Config{
 	// Single site mode doesn't need default endpoints.
 	createDefaultEndpoints: false,
 	adminPathPrefix:        "/goslow",
+	maxLoggedRequests:      DEFAULT_MAX_LOGGED_REQUESTS,
+	allowProxy:             false,
+	allowPrivateUpstreams:  false,
+	configFile:             "",
+	watchConfigFile:        false,
 }
 
 // NewConfigFromArgs returns a new config from command line arguments.
@@ -70,18 +82,49 @@ func (config *Config) defineFlags() {
 		`If not an empty string: run in single domain mode
 	and use the endpoint http://LISTEN-ON/ADMIN-PATH-PREFIX (default is http://localhost:5103/goslow)
 	to configurate responses`)
+
+	flag.IntVar(&config.maxLoggedRequests, "max-logged-requests", DEFAULT_CONFIG.maxLoggedRequests,
+		`number of the latest requests to remember per site, older requests are forgotten.
+	0 (default) turns off the request log. E.g: 100`)
+
+	flag.BoolVar(&config.allowProxy, "allow-proxy", DEFAULT_CONFIG.allowProxy,
+		"If true, then sites can proxy requests to upstreams (action=proxy and action=record).")
+
+	flag.BoolVar(&config.allowPrivateUpstreams, "allow-private-upstreams", DEFAULT_CONFIG.allowPrivateUpstreams,
+		`If true, then upstreams can be at loopback, private, link-local and unspecified addresses.
+	E.g when goslow runs locally in front of localhost:8080. Don't use it on a shared instance.`)
+
+	flag.StringVar(&config.configFile, "config-file", DEFAULT_CONFIG.configFile,
+		`YAML or JSON file with sites and endpoints to create before starting the server.
+	E.g: /path/to/goslow.yml`)
+
+	flag.BoolVar(&config.watchConfigFile, "watch-config-file", DEFAULT_CONFIG.watchConfigFile,
+		"If true, then reload changed endpoints of the config file without restarting the server.")
 }
 
 func (config *Config) parseFlags() {
 	flag.Parse()
+	config.args = flag.Args()
 }
 
 func (config *Config) validate() {
 	if config.createDefaultEndpoints && config.isInSingleSiteMode() {
 		log.Fatal("You can't use both --admin-path-prefix and --create-default-endpoints options")
 	}
+	if config.allowPrivateUpstreams && !config.allowProxy {
+		log.Fatal("You can't use --allow-private-upstreams without --allow-proxy option")
+	}
+	if config.watchConfigFile && config.configFile == "" {
+		log.Fatal("You can't use --watch-config-file without --config-file option")
+	}
 }
 
 func (config *Config) isInSingleSiteMode() bool {
 	return config.adminPathPrefix != ""
 }
+
+// Config.isInMemory is true for sqlite3 databases that are gone when the process exits (like the default one).
+func (config *Config) isInMemory() bool {
+	return config.driver == "sqlite3" &&
+		(strings.Contains(config.dataSource, ":memory:") || strings.Contains(config.dataSource, "mode=memory"))
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const CONFIG_FILE_POLL_INTERVAL = time.Second
+
+// Endpoint keys of the config file that aren't query params.
+const (
+	PATH_CONFIG_KEY      = "path"
+	HEADERS_CONFIG_KEY   = "headers"
+	BODY_CONFIG_KEY      = "body"
+	BODY_FILE_CONFIG_KEY = "body_file"
+)
+
+// Query params that can be used as endpoint keys of the config file.
+var CONFIG_ENDPOINT_PARAMS = []string{
+	METHOD_PARAM, STATUS_CODE_PARAM, DELAY_PARAM, SEED_PARAM, HEADER_PARAM, PATH_REGEXP_PARAM,
+	MATCH_QUERY_PARAM, MATCH_HEADER_PARAM, MATCH_BODY_PARAM, MATCH_BODY_REGEXP_PARAM, MATCH_JSON_PARAM,
+	BANDWIDTH_PARAM, CHUNK_SIZE_PARAM, BODY_DELAY_PARAM, STALL_DELAY_PARAM, STALL_AT_PARAM, FAULT_PARAM,
+	WEIGHT_PARAM, VARIANT_PARAM, STEP_PARAM, LOOP_PARAM, RATE_LIMIT_PARAM, RATE_LIMIT_KEY_PARAM,
+	RATE_LIMIT_BODY_PARAM, OUTAGE_PARAM, OUTAGE_RESPONSE_PARAM, MODE_PARAM,
+}
+
+// ConfigFile describes sites and their endpoints, e.g
+//
+//	sites:
+//	  - name: payments  # omitted in the single site mode
+//	    endpoints:
+//	      - path: /charge
+//	        method: POST
+//	        delay: 2.5
+//	        status: 201
+//	        headers: {Content-Type: application/json}
+//	        body_file: responses/charge.json  # relative to the config file
+//
+// Endpoints have the same keys as query params, JSON config files are fine too.
+type ConfigFile struct {
+	Sites []*SiteConfig `yaml:"sites"`
+}
+
+type SiteConfig struct {
+	Name      string            `yaml:"name"`
+	Endpoints []*EndpointConfig `yaml:"endpoints"`
+}
+
+// EndpointConfig is an endpoint of the config file, Params are query params made from its keys.
+type EndpointConfig struct {
+	Line     int
+	Path     string
+	Headers  map[string]string
+	Body     *string
+	BodyFile string
+	Params   url.Values
+}
+
+func (endpoint *EndpointConfig) UnmarshalYAML(node *yaml.Node) error {
+	endpoint.Line = node.Line
+	raw := make(map[string]interface{})
+	err := node.Decode(&raw)
+	if err != nil {
+		return err
+	}
+	endpoint.Params = make(url.Values)
+	for key, value := range raw {
+		switch {
+		case key == PATH_CONFIG_KEY:
+			endpoint.Path = fmt.Sprint(value)
+		case key == HEADERS_CONFIG_KEY:
+			headers, isMap := value.(map[string]interface{})
+			if !isMap {
+				return fmt.Errorf("line %d: headers should be a map of NAME: VALUE", node.Line)
+			}
+			endpoint.Headers = make(map[string]string)
+			for name, value := range headers {
+				endpoint.Headers[name] = fmt.Sprint(value)
+			}
+		case key == BODY_CONFIG_KEY:
+			body, err := makeConfigBody(value)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", node.Line, err)
+			}
+			endpoint.Body = &body
+		case key == BODY_FILE_CONFIG_KEY:
+			endpoint.BodyFile = fmt.Sprint(value)
+		case isConfigEndpointParam(key):
+			values, isList := value.([]interface{})
+			if !isList {
+				values = []interface{}{value}
+			}
+			for _, value := range values {
+				endpoint.Params.Add(key, fmt.Sprint(value))
+			}
+		default:
+			return fmt.Errorf("line %d: unknown endpoint key <%s>", node.Line, key)
+		}
+	}
+	_, hasPathRegexp := endpoint.Params[PATH_REGEXP_PARAM]
+	if endpoint.Path == "" && !hasPathRegexp {
+		return fmt.Errorf("line %d: endpoint should have either %s or %s", node.Line,
+			PATH_CONFIG_KEY, PATH_REGEXP_PARAM)
+	}
+	if endpoint.Body != nil && endpoint.BodyFile != "" {
+		return fmt.Errorf("line %d: endpoint can't have both %s and %s", node.Line,
+			BODY_CONFIG_KEY, BODY_FILE_CONFIG_KEY)
+	}
+	return nil
+}
+
+// makeConfigBody returns maps and lists as JSON, so `body: {id: 1}` responds with {"id":1}.
+func makeConfigBody(value interface{}) (string, error) {
+	switch value.(type) {
+	case nil:
+		return "", nil
+	case map[string]interface{}, []interface{}:
+		body, err := json.Marshal(value)
+		if err != nil {
+			return "", fmt.Errorf("%s can't be converted to JSON: %s", BODY_CONFIG_KEY, err)
+		}
+		return string(body), nil
+	case map[interface{}]interface{}:
+		return "", fmt.Errorf("%s can't be converted to JSON, its keys should be strings", BODY_CONFIG_KEY)
+	}
+	return fmt.Sprint(value), nil
+}
+
+func isConfigEndpointParam(key string) bool {
+	for _, param := range CONFIG_ENDPOINT_PARAMS {
+		if key == param {
+			return true
+		}
+	}
+	return false
+}
+
+// parseConfigFile returns errors prefixed with the file name, YAML errors have line numbers.
+func parseConfigFile(path string) (*ConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	configFile := &ConfigFile{}
+	err = decoder.Decode(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return configFile, nil
+}
+
+// ConfigLoader saves endpoints of the config file to the storage.
+// On reload only the changed endpoints are saved (so their sequences and rate limits start over)
+// and endpoints removed from the config file are deleted. Endpoints created by admin requests are left alone.
+type ConfigLoader struct {
+	server   *Server
+	path     string
+	loaded   map[string]*Endpoint // by Endpoint.Key()
+	modTimes map[string]time.Time // of the config file and body files
+}
+
+func NewConfigLoader(server *Server, path string) *ConfigLoader {
+	return &ConfigLoader{server: server, path: path, loaded: make(map[string]*Endpoint)}
+}
+
+// ConfigLoader.Load validates the whole config file before saving anything.
+// Mod times are taken before the files are read, so a change made while loading triggers a reload.
+func (loader *ConfigLoader) Load() error {
+	loader.modTimes = loader.getModTimes([]string{loader.path})
+	configFile, err := parseConfigFile(loader.path)
+	if err != nil {
+		return err
+	}
+	for path, modTime := range loader.getModTimes(loader.getBodyFiles(configFile)) {
+		loader.modTimes[path] = modTime
+	}
+	endpoints, err := loader.makeEndpoints(configFile)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		siteExists, err := loader.server.storage.SiteExists(endpoint.Site)
+		if err != nil {
+			return err
+		}
+		if !siteExists {
+			err = loader.server.storage.CreateSite(endpoint.Site)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	loaded := make(map[string]*Endpoint)
+	changed := 0
+	for _, endpoint := range endpoints {
+		loaded[endpoint.Key()] = endpoint
+		if reflect.DeepEqual(loader.loaded[endpoint.Key()], endpoint) {
+			continue
+		}
+		err = loader.server.saveEndpoint(endpoint)
+		if err != nil {
+			return err
+		}
+		changed++
+	}
+	deleted := 0
+	for key, endpoint := range loader.loaded {
+		if loaded[key] != nil {
+			continue
+		}
+		_, err = loader.server.deleteEndpoint(endpoint)
+		if err != nil {
+			return err
+		}
+		deleted++
+	}
+	loader.loaded = loaded
+	log.Printf("loaded %s: %d endpoints, %d changed, %d deleted", loader.path, len(endpoints), changed, deleted)
+	return nil
+}
+
+// ConfigLoader.getBodyFiles returns resolved body files of the config file.
+func (loader *ConfigLoader) getBodyFiles(configFile *ConfigFile) []string {
+	files := make([]string, 0)
+	for _, siteConfig := range configFile.Sites {
+		for _, endpointConfig := range siteConfig.Endpoints {
+			if endpointConfig.BodyFile != "" {
+				files = append(files, loader.resolve(endpointConfig.BodyFile))
+			}
+		}
+	}
+	return files
+}
+
+func (loader *ConfigLoader) makeEndpoints(configFile *ConfigFile) ([]*Endpoint, error) {
+	endpoints := make([]*Endpoint, 0)
+	lines := make(map[string]int)
+	for _, siteConfig := range configFile.Sites {
+		site := siteConfig.Name
+		switch {
+		case loader.server.isInSingleSiteMode() && site != EMPTY_SITE:
+			return nil, fmt.Errorf("%s: site <%s> can't be configured in the single site mode",
+				loader.path, site)
+		case !loader.server.isInSingleSiteMode() && (site == EMPTY_SITE || !canChange(site)):
+			return nil, fmt.Errorf("%s: site <%s> can't be configured", loader.path, site)
+		}
+		for _, endpointConfig := range siteConfig.Endpoints {
+			endpoint, err := loader.makeEndpoint(site, endpointConfig)
+			if err != nil {
+				return nil, fmt.Errorf("%s: line %d: %s", loader.path, endpointConfig.Line, err)
+			}
+			line, isDuplicate := lines[endpoint.Key()]
+			if isDuplicate {
+				return nil, fmt.Errorf("%s: line %d: endpoint %s is already configured at line %d",
+					loader.path, endpointConfig.Line, endpoint, line)
+			}
+			lines[endpoint.Key()] = endpointConfig.Line
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+// ConfigLoader.makeEndpoint makes an endpoint exactly like an admin request would.
+func (loader *ConfigLoader) makeEndpoint(site string, endpointConfig *EndpointConfig) (*Endpoint, error) {
+	body := []byte{}
+	if endpointConfig.Body != nil {
+		body = []byte(*endpointConfig.Body)
+	}
+	if endpointConfig.BodyFile != "" {
+		var err error
+		body, err = ioutil.ReadFile(loader.resolve(endpointConfig.BodyFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+	params := make(url.Values)
+	for key, values := range endpointConfig.Params {
+		params[key] = values
+	}
+	names := make([]string, 0)
+	for name := range endpointConfig.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		params.Add(HEADER_PARAM, name+HEADER_SEPARATOR+endpointConfig.Headers[name])
+	}
+	path := ensureHasPrefix(endpointConfig.Path, "/")
+	if loader.server.isInSingleSiteMode() {
+		path = loader.server.config.adminPathPrefix + path
+	}
+	req, err := http.NewRequest("POST", (&url.URL{Path: path, RawQuery: params.Encode()}).String(),
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return loader.server.makeEndpoint(site, req)
+}
+
+// ConfigLoader.resolve makes body file paths relative to the config file.
+func (loader *ConfigLoader) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(loader.path), path)
+}
+
+func (loader *ConfigLoader) getModTimes(paths []string) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range paths {
+		modTimes[path] = getModTime(path)
+	}
+	return modTimes
+}
+
+// getModTime returns zero time for missing files, so they are noticed when they appear.
+func getModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (loader *ConfigLoader) hasChanged() bool {
+	for path, modTime := range loader.modTimes {
+		if !getModTime(path).Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigLoader.Watch polls the config file and body files, and reloads them when they change.
+// Invalid config file is reported, previously loaded endpoints keep working.
+func (loader *ConfigLoader) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !loader.hasChanged() {
+			continue
+		}
+		err := loader.Load()
+		if err != nil {
+			log.Printf("error: can't reload config file: %s", err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"sync"
+)
+
+// Counters count requests per endpoint. They are safe for concurrent use.
+type Counters struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func NewCounters() *Counters {
+	return &Counters{counts: make(map[string]int)}
+}
+
+// Counters.Next returns the number of previous calls for the endpoint and increments it.
+func (counters *Counters) Next(endpoint *Endpoint) int {
+	counters.Lock()
+	defer counters.Unlock()
+	key := endpoint.Key()
+	count := counters.counts[key]
+	counters.counts[key] = count + 1
+	return count
+}
+
+func (counters *Counters) Reset(endpoint *Endpoint) {
+	counters.Lock()
+	defer counters.Unlock()
+	delete(counters.counts, endpoint.Key())
+}
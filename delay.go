@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delay distribution kinds.
+const (
+	UNIFORM_DISTRIBUTION     = "uniform"     // uniform(MIN,MAX)
+	NORMAL_DISTRIBUTION      = "normal"      // normal(MEAN,STDDEV)
+	EXPONENTIAL_DISTRIBUTION = "exponential" // exponential(MEAN)
+	PERCENTILES_DISTRIBUTION = "percentiles" // p50=200ms,p99=5s
+)
+
+const PERCENTILE_PREFIX = "p"
+
+// DelayDistribution describes a random delay sampled on every request.
+// Params are [MIN, MAX] for uniform, [MEAN, STDDEV] for normal, and [MEAN] for exponential distribution.
+type DelayDistribution struct {
+	Kind        string
+	Params      []time.Duration `json:",omitempty"`
+	Percentiles []*Percentile   `json:",omitempty"`
+}
+
+// Percentile {Percent: 99, Delay: 5s} means that 99% of requests are faster than 5 seconds.
+type Percentile struct {
+	Percent float64
+	Delay   time.Duration
+}
+
+// parseDelay parses a fixed delay (2.5 or 2500ms) or a delay distribution:
+// uniform(1,3), normal(200ms,50ms), exponential(0.5), or p50=200ms,p99=5s.
+// Bare numbers are seconds.
+// Exactly one of the returned delay and distribution is meaningful.
+func parseDelay(rawDelay string) (time.Duration, *DelayDistribution, error) {
+	rawDelay = strings.TrimSpace(rawDelay)
+	switch {
+	case strings.HasPrefix(rawDelay, PERCENTILE_PREFIX):
+		distribution, err := parsePercentiles(rawDelay)
+		return 0, distribution, err
+	case strings.HasSuffix(rawDelay, ")"):
+		distribution, err := parseDistribution(rawDelay)
+		return 0, distribution, err
+	}
+	delay, err := parseDelayValue(rawDelay)
+	return delay, nil, err
+}
+
+func parseDelayValue(rawDelay string) (time.Duration, error) {
+	rawDelay = strings.TrimSpace(rawDelay)
+	var delay time.Duration
+	seconds, err := strconv.ParseFloat(rawDelay, 64)
+	if err == nil {
+		delay = secondsToDuration(seconds)
+	} else {
+		delay, err = time.ParseDuration(rawDelay)
+		if err != nil {
+			return 0, InvalidDelayError(rawDelay)
+		}
+	}
+	if delay < MIN_DELAY {
+		return 0, InvalidDelayError(rawDelay)
+	}
+	if delay > MAX_DELAY {
+		return 0, DelayIsTooBigError(delay)
+	}
+	return delay, nil
+}
+
+// parseDistribution parses KIND(PARAM1,PARAM2,...).
+func parseDistribution(rawDelay string) (*DelayDistribution, error) {
+	open := strings.Index(rawDelay, "(")
+	if open == -1 {
+		return nil, InvalidDelayError(rawDelay)
+	}
+	distribution := &DelayDistribution{Kind: rawDelay[:open]}
+	for _, rawParam := range strings.Split(rawDelay[open+1:len(rawDelay)-1], ",") {
+		param, err := parseDelayValue(rawParam)
+		if err != nil {
+			return nil, err
+		}
+		distribution.Params = append(distribution.Params, param)
+	}
+
+	params := distribution.Params
+	switch {
+	case distribution.Kind == UNIFORM_DISTRIBUTION && len(params) == 2 && params[0] <= params[1]:
+	case distribution.Kind == NORMAL_DISTRIBUTION && len(params) == 2:
+	case distribution.Kind == EXPONENTIAL_DISTRIBUTION && len(params) == 1:
+	default:
+		return nil, InvalidDelayError(rawDelay)
+	}
+	return distribution, nil
+}
+
+// parsePercentiles parses pPERCENT=DELAY,pPERCENT=DELAY,...
+// Percents and delays should increase.
+func parsePercentiles(rawDelay string) (*DelayDistribution, error) {
+	distribution := &DelayDistribution{Kind: PERCENTILES_DISTRIBUTION}
+	for _, rawPercentile := range strings.Split(rawDelay, ",") {
+		parts := strings.SplitN(strings.TrimSpace(rawPercentile), "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], PERCENTILE_PREFIX) {
+			return nil, InvalidDelayError(rawDelay)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimPrefix(parts[0], PERCENTILE_PREFIX), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, InvalidDelayError(rawDelay)
+		}
+		delay, err := parseDelayValue(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		distribution.Percentiles = append(distribution.Percentiles, &Percentile{Percent: percent, Delay: delay})
+	}
+	for i := 1; i < len(distribution.Percentiles); i++ {
+		previous, current := distribution.Percentiles[i-1], distribution.Percentiles[i]
+		if current.Percent <= previous.Percent || current.Delay < previous.Delay {
+			return nil, InvalidDelayError(rawDelay)
+		}
+	}
+	return distribution, nil
+}
+
+// DelayDistribution.Sample returns a random delay between MIN_DELAY and MAX_DELAY.
+func (distribution *DelayDistribution) Sample(random Random) time.Duration {
+	var delay float64
+	params := distribution.Params
+	switch distribution.Kind {
+	case UNIFORM_DISTRIBUTION:
+		delay = float64(params[0]) + float64(params[1]-params[0])*random.Float64()
+	case NORMAL_DISTRIBUTION:
+		delay = float64(params[0]) + float64(params[1])*random.NormFloat64()
+	case EXPONENTIAL_DISTRIBUTION:
+		delay = float64(params[0]) * random.ExpFloat64()
+	case PERCENTILES_DISTRIBUTION:
+		delay = distribution.samplePercentiles(random.Float64() * 100)
+	}
+	delay = math.Max(delay, float64(MIN_DELAY))
+	delay = math.Min(delay, float64(MAX_DELAY))
+	return time.Duration(delay)
+}
+
+// samplePercentiles interpolates linearly between percentiles.
+// Implied p0 is zero delay, requests above the last percentile get the last delay.
+func (distribution *DelayDistribution) samplePercentiles(percent float64) float64 {
+	previous := &Percentile{Percent: 0, Delay: MIN_DELAY}
+	for _, percentile := range distribution.Percentiles {
+		if percent <= percentile.Percent {
+			if percentile.Percent == previous.Percent {
+				return float64(percentile.Delay)
+			}
+			fraction := (percent - previous.Percent) / (percentile.Percent - previous.Percent)
+			return float64(previous.Delay) + fraction*float64(percentile.Delay-previous.Delay)
+		}
+		previous = percentile
+	}
+	return float64(previous.Delay)
+}
+
+// DelayDistribution.String returns the same syntax that parseDelay accepts.
+func (distribution *DelayDistribution) String() string {
+	parts := make([]string, 0)
+	if distribution.Kind == PERCENTILES_DISTRIBUTION {
+		for _, percentile := range distribution.Percentiles {
+			parts = append(parts, fmt.Sprintf("%s%g=%s", PERCENTILE_PREFIX, percentile.Percent, percentile.Delay))
+		}
+		return strings.Join(parts, ",")
+	}
+	for _, param := range distribution.Params {
+		parts = append(parts, param.String())
+	}
+	return fmt.Sprintf("%s(%s)", distribution.Kind, strings.Join(parts, ","))
+}
@@ -1,31 +1,297 @@
 package main
 
 import (
+	"container/list"
+	"fmt"
 	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	ANY_SEGMENT   = "*"  // matches exactly one path segment
+	ANY_SEGMENTS  = "**" // matches zero or more path segments
+	GLOB_SPECIALS = "*?["
+)
+
+// Path kinds from the least specific to the most specific.
+const (
+	ANY_PATH = iota
+	GLOB_PATH
+	REGEXP_PATH // regexp is an explicit opt-in, so it beats globs
+	EXACT_PATH
+)
+
 // If Path/Method is an empty string, then endpoint handles
 // any path/HTTP method.
 type Endpoint struct {
-	Site       string
-	Path       string
-	Method     string
-	Headers    map[string]string
-	Delay      time.Duration
-	StatusCode int
-	Response   []byte
+	Site              string
+	Path              string // glob pattern, e.g. /users/*/orders/**
+	PathIsRegexp      bool   // Path is a regexp then, e.g. ^/v[0-9]+/items/(?P<id>\d+)$
+	Method            string
+	Predicates        []*Predicate // request should satisfy all of them
+	Headers           http.Header
+	Delay             time.Duration      // time to first byte
+	DelayDistribution *DelayDistribution // used instead of Delay if not nil
+	Seed              *int64             // makes random delays reproducible, nil means random values
+	StatusCode        int
+	Response          []byte
+	BytesPerSecond    int // if positive, then Response is trickled in chunks of ChunkSize bytes
+	ChunkSize         int
+	BodyDelay         time.Duration // pause between headers and body
+	StallDelay        time.Duration // pause after the first StallOffset bytes of the body
+	StallOffset       int
+	Fault             string // if not empty, then the connection is broken instead of responding, see FAULTS
+	Weight            int
+	Variants          []*Variant // alternative responses chosen randomly according to their weights and Weight
+	Sequence          []*Variant // responses to the first requests, see Endpoint.ChooseStep
+	Loop              bool
+	RateLimit         *RateLimit      // requests over it get 429 instead of any of the responses above
+	Outage            *OutageSchedule // windows with the outage response, requests aren't counted by RateLimit then
+	Mode              string          // STATIC_MODE, TEMPLATE_MODE (see RequestData) or ECHO_MODE (see EchoData)
+}
+
+// Endpoint.Key identifies an endpoint the same way as the primary key in the endpoints table.
+func (endpoint *Endpoint) Key() string {
+	parts := []string{endpoint.Site, endpoint.Path, endpoint.Method}
+	for _, predicate := range endpoint.Predicates {
+		parts = append(parts, predicate.String())
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// Endpoint.String returns e.g GET /users/* with query q=goslow
+func (endpoint *Endpoint) String() string {
+	method := endpoint.Method
+	if method == MATCHES_ANY_STRING {
+		method = "ANY"
+	}
+	result := fmt.Sprintf("%s %s", method, endpoint.Path)
+	if len(endpoint.Predicates) > 0 {
+		predicates := make([]string, 0)
+		for _, predicate := range endpoint.Predicates {
+			predicates = append(predicates, predicate.String())
+		}
+		result += " with " + strings.Join(predicates, ", ")
+	}
+	return result
+}
+
+// Endpoint.SampleDelay returns a delay for the next request.
+func (endpoint *Endpoint) SampleDelay(random Random) time.Duration {
+	if endpoint.DelayDistribution == nil {
+		return endpoint.Delay
+	}
+	return endpoint.DelayDistribution.Sample(random)
 }
 
 func (endpoint *Endpoint) Matches(req *http.Request) bool {
-	return matches(endpoint.Path, req.URL.Path) && matches(endpoint.Method, req.Method)
+	return endpoint.matchesPath(req.URL.Path) && matches(endpoint.Method, req.Method) &&
+		matchesAll(endpoint.Predicates, req)
+}
+
+func (endpoint *Endpoint) matchesPath(urlPath string) bool {
+	if endpoint.PathIsRegexp {
+		re, err := compileRegexp(endpoint.Path)
+		return err == nil && re.MatchString(urlPath)
+	}
+	return matchesPath(endpoint.Path, urlPath)
+}
+
+// Endpoint.ExpandResponse replaces $1, $name, and ${name} in the response
+// with the groups captured by the regexp path.
+// Response of a non-regexp endpoint is returned as is.
+func (endpoint *Endpoint) ExpandResponse(req *http.Request) []byte {
+	if !endpoint.PathIsRegexp {
+		return endpoint.Response
+	}
+	re, err := compileRegexp(endpoint.Path)
+	if err != nil {
+		return endpoint.Response
+	}
+	submatches := re.FindStringSubmatchIndex(req.URL.Path)
+	if submatches == nil {
+		return endpoint.Response
+	}
+	return re.Expand(nil, endpoint.Response, []byte(req.URL.Path), submatches)
+}
+
+const MAX_COMPILED_REGEXPS = 1000
+
+// compiledRegexps caches regexps, because endpoints are loaded from a database on every request.
+// Patterns come from users, so the cache is bounded: the least recently used regexp is evicted.
+var compiledRegexps = struct {
+	sync.Mutex
+	cache map[string]*list.Element // values of the elements are *regexp.Regexp
+	lru   *list.List               // the most recently used regexp is in the front
+}{cache: make(map[string]*list.Element), lru: list.New()}
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	compiledRegexps.Lock()
+	defer compiledRegexps.Unlock()
+	element, found := compiledRegexps.cache[pattern]
+	if found {
+		compiledRegexps.lru.MoveToFront(element)
+		return element.Value.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	compiledRegexps.cache[pattern] = compiledRegexps.lru.PushFront(re)
+	if compiledRegexps.lru.Len() > MAX_COMPILED_REGEXPS {
+		oldest := compiledRegexps.lru.Back()
+		compiledRegexps.lru.Remove(oldest)
+		delete(compiledRegexps.cache, oldest.Value.(*regexp.Regexp).String())
+	}
+	return re, nil
 }
 
 // Empty pattern matches anything.
 // Pattern is just a string - special characters (*?.) are not special and interpreted as is.
+// Used for HTTP methods, see matchesPath for paths.
 func matches(pattern, s string) bool {
 	if pattern == MATCHES_ANY_STRING {
 		return true
 	}
 	return pattern == s
 }
+
+// Empty pattern matches any path.
+// Pattern is matched segment by segment: "*" matches exactly one segment,
+// "**" matches zero or more segments, other segments are matched with path.Match,
+// so "user-?" and "*.js" work too.
+func matchesPath(pattern, urlPath string) bool {
+	if pattern == MATCHES_ANY_STRING {
+		return true
+	}
+	if !isGlob(pattern) {
+		return pattern == urlPath
+	}
+	return matchesSegments(splitPath(pattern), splitPath(urlPath))
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, GLOB_SPECIALS)
+}
+
+// escapeGlob("/files/*.txt") returns "/files/\\*.txt", a glob pattern matching only the path itself.
+func escapeGlob(urlPath string) string {
+	if !isGlob(urlPath) {
+		return urlPath
+	}
+	var escaped strings.Builder
+	for _, char := range urlPath {
+		if strings.ContainsRune(GLOB_SPECIALS+"\\", char) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(char)
+	}
+	return escaped.String()
+}
+
+// checkGlob rejects malformed patterns (e.g /a/[) that would never match anything.
+func checkGlob(pattern string) error {
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return InvalidPathGlobError(pattern, err)
+	}
+	return nil
+}
+
+// splitPath("/users/1/") returns ["users", "1", ""], trailing slash is significant.
+func splitPath(urlPath string) []string {
+	return strings.Split(strings.TrimPrefix(urlPath, "/"), "/")
+}
+
+func matchesSegments(patterns, segments []string) bool {
+	if len(patterns) == 0 {
+		return len(segments) == 0
+	}
+	if patterns[0] == ANY_SEGMENTS {
+		for i := 0; i <= len(segments); i++ {
+			if matchesSegments(patterns[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if segments[0] == "" && isGlob(patterns[0]) {
+		return false // "*" matches exactly one segment, and an empty segment doesn't count
+	}
+	matched, err := path.Match(patterns[0], segments[0])
+	if err != nil || !matched {
+		return false
+	}
+	return matchesSegments(patterns[1:], segments[1:])
+}
+
+// Specificity ranks endpoints matching the same request.
+// The most specific endpoint wins.
+type Specificity struct {
+	pathKind         int
+	literalSegments  int // segments without special characters
+	wildcardSegments int // "*" and other single segment globs
+	anySegments      int // "**"
+	predicates       int
+	hasMethod        bool
+}
+
+func (endpoint *Endpoint) Specificity() Specificity {
+	specificity := Specificity{
+		pathKind:   endpoint.pathKind(),
+		predicates: len(endpoint.Predicates),
+		hasMethod:  endpoint.Method != MATCHES_ANY_STRING,
+	}
+	if specificity.pathKind != GLOB_PATH {
+		return specificity
+	}
+	for _, segment := range splitPath(endpoint.Path) {
+		switch {
+		case segment == ANY_SEGMENTS:
+			specificity.anySegments++
+		case isGlob(segment):
+			specificity.wildcardSegments++
+		default:
+			specificity.literalSegments++
+		}
+	}
+	return specificity
+}
+
+func (endpoint *Endpoint) pathKind() int {
+	switch {
+	case endpoint.PathIsRegexp:
+		return REGEXP_PATH
+	case endpoint.Path == MATCHES_ANY_STRING:
+		return ANY_PATH
+	case isGlob(endpoint.Path):
+		return GLOB_PATH
+	}
+	return EXACT_PATH
+}
+
+// Specificity.MoreSpecificThan compares path first, number of predicates second, and HTTP method third.
+// Exact paths beat regexps, regexps beat globs, globs beat the empty path.
+// Among globs more literal segments win, then fewer "**", then more single segment wildcards.
+func (specificity Specificity) MoreSpecificThan(other Specificity) bool {
+	switch {
+	case specificity.pathKind != other.pathKind:
+		return specificity.pathKind > other.pathKind
+	case specificity.literalSegments != other.literalSegments:
+		return specificity.literalSegments > other.literalSegments
+	case specificity.anySegments != other.anySegments:
+		return specificity.anySegments < other.anySegments
+	case specificity.wildcardSegments != other.wildcardSegments:
+		return specificity.wildcardSegments > other.wildcardSegments
+	case specificity.predicates != other.predicates:
+		return specificity.predicates > other.predicates
+	}
+	return specificity.hasMethod && !other.hasMethod
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -14,8 +16,8 @@ Please try again in a few seconds or contact codumentary.com@gmail.com for help
 `
 
 type ApiError struct {
-	Message    string
-	StatusCode int
+	Message    string `json:"error"`
+	StatusCode int    `json:"status_code"`
 }
 
 // NewApiError returns an ApiError with the the message made from the format string.
@@ -32,7 +34,119 @@ func (error *ApiError) Error() string {
 
 func InvalidDelayError(rawDelay string) error {
 	return NewApiError(http.StatusBadRequest,
-		"Oopsie daisy! Could not convert delay <%s> to float.", rawDelay)
+		"Oopsie daisy! Could not parse delay <%s>. "+
+			"Expecting seconds (2.5), duration (2500ms), uniform(MIN,MAX), normal(MEAN,STDDEV), "+
+			"exponential(MEAN), or percentiles (p50=200ms,p99=5s).", rawDelay)
+}
+
+func InvalidSeedError(rawSeed string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Could not convert seed <%s> to integer.", rawSeed)
+}
+
+func NotPositiveIntError(param, rawValue string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Parameter %s should be a positive integer, got <%s>.", param, rawValue)
+}
+
+func InvalidStallOffsetError(rawStallAt string, responseLength int) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Stall offset should be between 0 and response length %d, got <%s>.",
+		responseLength, rawStallAt)
+}
+
+func UnknownFaultError(fault string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Unknown fault <%s>. Known faults are: %s.", fault, strings.Join(FAULTS, ", "))
+}
+
+func InvalidWeightError(rawWeight string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Weight should be a non-negative integer, got <%s>.", rawWeight)
+}
+
+func InvalidVariantError(rawVariant, reason string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Invalid variant <%s>: %s.", rawVariant, reason)
+}
+
+func InvalidBoolError(param, rawValue string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Parameter %s should be true or false, got <%s>.", param, rawValue)
+}
+
+func UnknownActionError(action string) error {
+	return NewApiError(http.StatusBadRequest, "Oopsie daisy! Unknown action <%s>.", action)
+}
+
+func InvalidRateLimitError(rawRateLimit string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Invalid rate limit <%s>, expecting REQUESTS/INTERVAL (e.g 10/60 or 10/1m).", rawRateLimit)
+}
+
+func InvalidRateLimitKeyError(key string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Invalid rate limit key <%s>, expecting %s or %sNAME.",
+		key, IP_RATE_LIMIT_KEY, HEADER_RATE_LIMIT_PREFIX)
+}
+
+func InvalidOutageError(rawWindow string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Invalid outage <%s>, expecting LENGTH/PERIOD (e.g 30s/5m), "+
+			"LENGTH/PERIOD@OFFSET (e.g 30s/5m@1m), or daily START-END in UTC (e.g 09:00-09:15).", rawWindow)
+}
+
+func UnknownModeError(mode string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Unknown mode <%s>. Known modes are: %s.", mode, strings.Join(MODES, ", "))
+}
+
+func InvalidResponseTemplateError(err error) error {
+	return NewApiError(http.StatusBadRequest, "Oopsie daisy! Invalid response template: %s", err)
+}
+
+func ResponseTemplateError(err error) error {
+	return NewApiError(http.StatusInternalServerError, "Oopsie daisy! Could not render response template: %s", err)
+}
+
+func NegativeIntError(param, rawValue string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Parameter %s should be a non-negative integer, got <%s>.", param, rawValue)
+}
+
+func InvalidTimesError(minTimes, maxTimes int) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! min_times can't be greater than max_times, got %d and %d.", minTimes, maxTimes)
+}
+
+func InvalidUpstreamError(rawUpstream string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Upstream should be an absolute http or https URL, got <%s>.", rawUpstream)
+}
+
+func UnresolvableUpstreamError(rawUpstream string, err error) error {
+	return NewApiError(http.StatusBadRequest, "Oopsie daisy! Could not resolve upstream <%s>: %s", rawUpstream, err)
+}
+
+func PrivateUpstreamError(rawUpstream string, ip net.IP) error {
+	return NewApiError(http.StatusForbidden,
+		"Oopsie daisy! Upstream <%s> resolves to the private address %s. "+
+			"Run goslow with --allow-private-upstreams to proxy to it.", rawUpstream, ip)
+}
+
+func ProxyIsOffError() error {
+	return NewApiError(http.StatusForbidden,
+		"Oopsie daisy! Proxy is turned off. Run goslow with --allow-proxy to turn it on.")
+}
+
+func InvalidStatusCodeError(rawStatusCode string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Status code should be a three-digit integer, got <%s>.", rawStatusCode)
+}
+
+func InvalidErrorRateError(rawErrorRate string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Error rate should be a number between 0 and 1, got <%s>.", rawErrorRate)
 }
 
 func DelayIsTooBigError(delay time.Duration) error {
@@ -41,6 +155,26 @@ func DelayIsTooBigError(delay time.Duration) error {
 		MAX_DELAY, delay)
 }
 
+func InvalidPathRegexpError(pathRegexp string, err error) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Could not compile path regex <%s>: %s", pathRegexp, err)
+}
+
+func InvalidPathGlobError(pattern string, err error) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Invalid path pattern <%s>: %s", pattern, err)
+}
+
+func InvalidPredicateError(rawPredicate, reason string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Invalid request condition <%s>: %s", rawPredicate, reason)
+}
+
+func InvalidHeaderError(rawHeader string) error {
+	return NewApiError(http.StatusBadRequest,
+		"Oopsie daisy! Invalid header <%s>, expecting NAME:VALUE.", rawHeader)
+}
+
 func CantChangeBuiltinSiteError() error {
 	return NewApiError(http.StatusForbidden, "Oopsie daisy! You can't change builtin sites.")
 }
@@ -53,3 +187,47 @@ func UnknownSiteError(site string) error {
 func CantCreateSiteError() error {
 	return NewApiError(http.StatusInternalServerError, CANT_CREATE_SITE_ERROR)
 }
+
+func RequestLogIsOffError() error {
+	return NewApiError(http.StatusConflict,
+		"Oopsie daisy! Can't verify expectations, the request log is off. Run goslow with --max-logged-requests N.")
+}
+
+func UnknownApiPathError(path, endpointsPath string) error {
+	return NewApiError(http.StatusNotFound,
+		"Oopsie daisy! Unknown API path <%s>, expecting %s or %s/ID.", path, endpointsPath, endpointsPath)
+}
+
+func MethodNotAllowedError(method, path string) error {
+	return NewApiError(http.StatusMethodNotAllowed,
+		"Oopsie daisy! Method %s isn't allowed for <%s>.", method, path)
+}
+
+func UnknownEndpointError(id string) error {
+	return NewApiError(http.StatusNotFound, "Oopsie daisy! Endpoint <%s> doesn't exist.", id)
+}
+
+func EndpointExistsError(endpoint *Endpoint) error {
+	return NewApiError(http.StatusConflict, "Oopsie daisy! Endpoint <%s> already exists.", endpoint)
+}
+
+func InvalidEndpointJsonError(err error) error {
+	return NewApiError(http.StatusBadRequest, "Oopsie daisy! Could not decode endpoint JSON: %s", err)
+}
+
+func NullElementError(field string) error {
+	return NewApiError(http.StatusBadRequest, "Oopsie daisy! %s can't contain null.", field)
+}
+
+func CantDeleteSingleSiteError() error {
+	return NewApiError(http.StatusForbidden,
+		"Oopsie daisy! You can't delete the only site in the single site mode, use action=%s instead.", CLEAR_ACTION)
+}
+
+func InvalidBundleError(reason string) error {
+	return NewApiError(http.StatusBadRequest, "Oopsie daisy! Invalid site bundle: %s.", reason)
+}
+
+func InvalidOpenApiSpecError(reason string) error {
+	return NewApiError(http.StatusBadRequest, "Oopsie daisy! Invalid OpenAPI spec: %s.", reason)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const UNLIMITED_TIMES = -1
+
+// Expectation declares that requests matching Path, Method and Predicates (same as for endpoints)
+// are made between MinTimes and MaxTimes times. MaxTimes is UNLIMITED_TIMES if there's no upper bound.
+// LastRequestId is the latest logged request when the expectation was added (set by Storage.SaveExpectation).
+type Expectation struct {
+	Id            int64
+	Site          string
+	Path          string
+	PathIsRegexp  bool
+	Method        string
+	Predicates    []*Predicate
+	MinTimes      int
+	MaxTimes      int
+	LastRequestId int64
+}
+
+func (expectation *Expectation) endpoint() *Endpoint {
+	return &Endpoint{Site: expectation.Site, Path: expectation.Path, PathIsRegexp: expectation.PathIsRegexp,
+		Method: expectation.Method, Predicates: expectation.Predicates}
+}
+
+func (expectation *Expectation) Matches(request *LoggedRequest) bool {
+	return expectation.endpoint().Matches(request.HttpRequest())
+}
+
+func (expectation *Expectation) IsSatisfiedBy(count int) bool {
+	return count >= expectation.MinTimes && (expectation.MaxTimes == UNLIMITED_TIMES || count <= expectation.MaxTimes)
+}
+
+// Expectation.Times returns e.g "exactly 1 time" or "at least 2 times"
+func (expectation *Expectation) Times() string {
+	min, max := expectation.MinTimes, expectation.MaxTimes
+	switch {
+	case min == max:
+		return "exactly " + pluralizeTimes(min)
+	case max == UNLIMITED_TIMES:
+		return "at least " + pluralizeTimes(min)
+	case min == 0:
+		return "at most " + pluralizeTimes(max)
+	}
+	return fmt.Sprintf("between %d and %s", min, pluralizeTimes(max))
+}
+
+func pluralizeTimes(n int) string {
+	if n == 1 {
+		return "1 time"
+	}
+	return fmt.Sprintf("%d times", n)
+}
+
+func (expectation *Expectation) String() string {
+	return fmt.Sprintf("%s called %s", expectation.endpoint(), expectation.Times())
+}
+
+// LoggedRequest.HttpRequest returns the request as it was received, so endpoint predicates can be applied to it.
+func (request *LoggedRequest) HttpRequest() *http.Request {
+	return &http.Request{
+		Method: request.Method,
+		URL:    &url.URL{Path: request.Path, RawQuery: request.Query.Encode()},
+		Header: request.Headers,
+		Body:   ioutil.NopCloser(strings.NewReader(request.Body)),
+	}
+}
+
+// Verification is the result of checking logged requests against expectations.
+// Unexpected requests don't match any expectation, they fail the verification unless they are allowed.
+// Verification is inconclusive (and doesn't pass) if the request log has forgotten requests
+// received after some of the expectations were added.
+type Verification struct {
+	Passed       bool                 `json:"passed"`
+	Inconclusive bool                 `json:"inconclusive"`
+	Expectations []*ExpectationResult `json:"expectations"`
+	Unexpected   []*LoggedRequest     `json:"unexpected"`
+}
+
+type ExpectationResult struct {
+	Expectation string `json:"expectation"`
+	Expected    string `json:"expected"`
+	Actual      int    `json:"actual"`
+	Passed      bool   `json:"passed"`
+}
+
+// verify needs lastTrimmedId (see Storage.GetLastTrimmedRequestId) to tell if the requests are complete.
+func verify(expectations []*Expectation, requests []*LoggedRequest, allowUnexpected bool,
+	lastTrimmedId int64) *Verification {
+	verification := &Verification{
+		Passed:       true,
+		Expectations: make([]*ExpectationResult, 0),
+		Unexpected:   make([]*LoggedRequest, 0),
+	}
+	counts := make([]int, len(expectations))
+	for _, request := range requests {
+		expected := false
+		for i, expectation := range expectations {
+			if expectation.Matches(request) {
+				counts[i]++
+				expected = true
+			}
+		}
+		if !expected {
+			verification.Unexpected = append(verification.Unexpected, request)
+		}
+	}
+	for i, expectation := range expectations {
+		result := &ExpectationResult{
+			Expectation: expectation.endpoint().String(),
+			Expected:    expectation.Times(),
+			Actual:      counts[i],
+			Passed:      expectation.IsSatisfiedBy(counts[i]),
+		}
+		verification.Expectations = append(verification.Expectations, result)
+		verification.Passed = verification.Passed && result.Passed
+	}
+	if !allowUnexpected && len(verification.Unexpected) > 0 {
+		verification.Passed = false
+	}
+	for _, expectation := range expectations {
+		if lastTrimmedId > expectation.LastRequestId {
+			verification.Inconclusive = true
+			verification.Passed = false
+		}
+	}
+	return verification
+}
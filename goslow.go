@@ -4,14 +4,22 @@ package main
 
 import (
 	"log"
+	"os"
 	"runtime"
 )
 
-// main starts a server.
+// main starts a server or runs a subcommand (e.g export).
 func main() {
 	useSeveralCPU()
 
 	config := NewConfigFromArgs()
+	if len(config.args) > 0 {
+		err := runSubcommand(config, config.args, os.Stdin, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	server := NewServer(config)
 
 	log.Fatal(server.ListenAndServe())
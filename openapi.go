@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const OPENAPI_COMMAND = "openapi" // goslow [OPTIONS] openapi [--delay DELAY] [--replace] [SITE] < spec.yml
+
+const (
+	MAX_SCHEMA_DEPTH   = 8 // recursive schemas are cut at this depth
+	OPENAPI_REF_PREFIX = "#/components/"
+)
+
+// Methods of the OpenAPI path item, in the order endpoints are created.
+var OPENAPI_METHODS = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// Sample values of string schemas by their format.
+var SAMPLE_STRINGS = map[string]string{
+	"date":      "2015-10-21",
+	"date-time": "2015-10-21T16:29:00Z",
+	"email":     "marty@example.com",
+	"hostname":  "example.com",
+	"ipv4":      "127.0.0.1",
+	"ipv6":      "::1",
+	"uri":       "http://example.com",
+	"uuid":      "3fa85f64-5717-4562-b3fc-2c963f66afa6",
+}
+
+var PATH_TEMPLATE_REGEXP = regexp.MustCompile(`{[^/{}]*}`)
+
+// OpenApiSpec is the part of the OpenAPI 3 specification that describes responses.
+// Both YAML and JSON specs are fine, unknown fields are ignored.
+type OpenApiSpec struct {
+	OpenApi    string                      `yaml:"openapi"`
+	Swagger    string                      `yaml:"swagger"`
+	Servers    []*OpenApiServer            `yaml:"servers"`
+	Paths      map[string]*OpenApiPathItem `yaml:"paths"`
+	Components *OpenApiComponents          `yaml:"components"`
+}
+
+type OpenApiServer struct {
+	Url       string                            `yaml:"url"`
+	Variables map[string]*OpenApiServerVariable `yaml:"variables"`
+}
+
+type OpenApiServerVariable struct {
+	Default string `yaml:"default"`
+}
+
+type OpenApiPathItem struct {
+	Get     *OpenApiOperation `yaml:"get"`
+	Put     *OpenApiOperation `yaml:"put"`
+	Post    *OpenApiOperation `yaml:"post"`
+	Delete  *OpenApiOperation `yaml:"delete"`
+	Options *OpenApiOperation `yaml:"options"`
+	Head    *OpenApiOperation `yaml:"head"`
+	Patch   *OpenApiOperation `yaml:"patch"`
+	Trace   *OpenApiOperation `yaml:"trace"`
+}
+
+type OpenApiOperation struct {
+	Responses map[string]*OpenApiResponse `yaml:"responses"`
+}
+
+type OpenApiResponse struct {
+	Ref     string                       `yaml:"$ref"`
+	Content map[string]*OpenApiMediaType `yaml:"content"`
+}
+
+type OpenApiMediaType struct {
+	Schema   *OpenApiSchema             `yaml:"schema"`
+	Example  interface{}                `yaml:"example"`
+	Examples map[string]*OpenApiExample `yaml:"examples"`
+}
+
+type OpenApiExample struct {
+	Ref   string      `yaml:"$ref"`
+	Value interface{} `yaml:"value"`
+}
+
+// OpenApiSchema.Type is a string in OpenAPI 3.0 and can be a list in OpenAPI 3.1.
+type OpenApiSchema struct {
+	Ref        string                    `yaml:"$ref"`
+	Type       interface{}               `yaml:"type"`
+	Format     string                    `yaml:"format"`
+	Properties map[string]*OpenApiSchema `yaml:"properties"`
+	Items      *OpenApiSchema            `yaml:"items"`
+	AllOf      []*OpenApiSchema          `yaml:"allOf"`
+	OneOf      []*OpenApiSchema          `yaml:"oneOf"`
+	AnyOf      []*OpenApiSchema          `yaml:"anyOf"`
+	Example    interface{}               `yaml:"example"`
+	Examples   []interface{}             `yaml:"examples"`
+	Default    interface{}               `yaml:"default"`
+	Enum       []interface{}             `yaml:"enum"`
+}
+
+type OpenApiComponents struct {
+	Schemas   map[string]*OpenApiSchema   `yaml:"schemas"`
+	Responses map[string]*OpenApiResponse `yaml:"responses"`
+	Examples  map[string]*OpenApiExample  `yaml:"examples"`
+}
+
+func decodeOpenApiSpec(reader io.Reader) (*OpenApiSpec, error) {
+	spec := &OpenApiSpec{}
+	err := yaml.NewDecoder(reader).Decode(spec)
+	if err != nil {
+		return nil, InvalidOpenApiSpecError(err.Error())
+	}
+	if spec.Swagger != "" {
+		return nil, InvalidOpenApiSpecError(fmt.Sprintf("Swagger %s isn't supported, convert it to OpenAPI 3",
+			spec.Swagger))
+	}
+	if !strings.HasPrefix(spec.OpenApi, "3.") {
+		return nil, InvalidOpenApiSpecError(fmt.Sprintf("unsupported version <%s>", spec.OpenApi))
+	}
+	if spec.Components == nil {
+		spec.Components = &OpenApiComponents{}
+	}
+	return spec, nil
+}
+
+// OpenApiSpec.toBundle makes an endpoint for every operation of the spec.
+// Endpoint responds with the first success response of the operation,
+// its body is the documented example or a sample generated from the schema.
+func (spec *OpenApiSpec) toBundle(site string, delay time.Duration, delayDistribution *DelayDistribution) (*SiteBundle, error) {
+	basePath, err := spec.getBasePath()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0)
+	for path := range spec.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	endpoints := make([]*Endpoint, 0)
+	for _, path := range paths {
+		pathItem := spec.Paths[path]
+		if pathItem == nil {
+			continue // a null path item has no operations
+		}
+		operations := pathItem.operations()
+		for _, method := range OPENAPI_METHODS {
+			operation := operations[method]
+			if operation == nil {
+				continue
+			}
+			endpoint, err := spec.makeEndpoint(operation)
+			if err != nil {
+				return nil, InvalidOpenApiSpecError(fmt.Sprintf("%s %s: %s", strings.ToUpper(method), path, err))
+			}
+			endpoint.Site = site
+			endpoint.Path = basePath + PATH_TEMPLATE_REGEXP.ReplaceAllString(ensureHasPrefix(path, "/"), ANY_SEGMENT)
+			endpoint.Method = strings.ToUpper(method)
+			endpoint.Delay = delay
+			endpoint.DelayDistribution = delayDistribution
+			err = endpoint.normalize()
+			if err != nil {
+				return nil, err
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return &SiteBundle{Version: BUNDLE_VERSION, Site: site, Endpoints: endpoints}, nil
+}
+
+// OpenApiSpec.getBasePath returns the path of the first server url, e.g /v1 for https://example.com/v1/
+func (spec *OpenApiSpec) getBasePath() (string, error) {
+	if len(spec.Servers) == 0 {
+		return "", nil
+	}
+	server := spec.Servers[0]
+	if server == nil {
+		return "", InvalidOpenApiSpecError("the first server is null")
+	}
+	rawUrl := server.Url
+	for name, variable := range server.Variables {
+		if variable == nil {
+			return "", InvalidOpenApiSpecError(fmt.Sprintf("server variable <%s> is null", name))
+		}
+		rawUrl = strings.Replace(rawUrl, "{"+name+"}", variable.Default, -1)
+	}
+	serverUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", InvalidOpenApiSpecError(fmt.Sprintf("invalid server url <%s>", server.Url))
+	}
+	return strings.TrimSuffix(serverUrl.Path, "/"), nil
+}
+
+func (pathItem *OpenApiPathItem) operations() map[string]*OpenApiOperation {
+	return map[string]*OpenApiOperation{
+		"get": pathItem.Get, "put": pathItem.Put, "post": pathItem.Post, "delete": pathItem.Delete,
+		"options": pathItem.Options, "head": pathItem.Head, "patch": pathItem.Patch, "trace": pathItem.Trace,
+	}
+}
+
+// OpenApiSpec.makeEndpoint has the same defaults as an endpoint created by POST to the admin domain.
+func (spec *OpenApiSpec) makeEndpoint(operation *OpenApiOperation) (*Endpoint, error) {
+	endpoint := &Endpoint{StatusCode: DEFAULT_STATUS_CODE, Weight: DEFAULT_WEIGHT, Headers: make(http.Header),
+		Response: []byte{}}
+	statusCode, response, err := spec.chooseResponse(operation.Responses)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.StatusCode = statusCode
+	if response == nil || !bodyAllowedForStatus(statusCode) {
+		return endpoint, nil
+	}
+	contentType := chooseContentType(response.Content)
+	if contentType == "" {
+		return endpoint, nil
+	}
+	if !strings.Contains(contentType, "*") {
+		endpoint.Headers.Set("Content-Type", contentType)
+	}
+	body, err := spec.makeBody(contentType, response.Content[contentType])
+	if err != nil {
+		return nil, err
+	}
+	endpoint.Response = body
+	endpoint.StallOffset = len(body) / 2 // same as getStallOffset
+	return endpoint, nil
+}
+
+// OpenApiSpec.chooseResponse prefers the lowest 2xx status code, then the default response,
+// then the lowest status code. 2XX ranges become 200, the default response becomes 200.
+func (spec *OpenApiSpec) chooseResponse(responses map[string]*OpenApiResponse) (int, *OpenApiResponse, error) {
+	if len(responses) == 0 {
+		return DEFAULT_STATUS_CODE, nil, nil
+	}
+	chosen := ""
+	chosenStatusCode := 0
+	for status := range responses {
+		statusCode := DEFAULT_STATUS_CODE
+		if status != "default" {
+			var err error
+			statusCode, err = strconv.Atoi(strings.Replace(strings.ToUpper(status), "X", "0", -1))
+			if err != nil {
+				return 0, nil, fmt.Errorf("invalid status code <%s>", status)
+			}
+		}
+		if chosen == "" || rankStatus(status, statusCode) < rankStatus(chosen, chosenStatusCode) {
+			chosen = status
+			chosenStatusCode = statusCode
+		}
+	}
+	response, err := spec.resolveResponse(responses[chosen])
+	if err != nil {
+		return 0, nil, err
+	}
+	return chosenStatusCode, response, nil
+}
+
+func rankStatus(status string, statusCode int) int {
+	switch {
+	case status == "default":
+		return 1000
+	case statusCode >= 200 && statusCode < 300:
+		return statusCode - 1000
+	}
+	return statusCode + 1000
+}
+
+// bodyAllowedForStatus is the same as in net/http.
+func bodyAllowedForStatus(statusCode int) bool {
+	switch {
+	case statusCode >= 100 && statusCode < 200:
+		return false
+	case statusCode == http.StatusNoContent, statusCode == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// chooseContentType prefers application/json, then any JSON content type, then the first one.
+func chooseContentType(content map[string]*OpenApiMediaType) string {
+	contentTypes := make([]string, 0)
+	for contentType := range content {
+		contentTypes = append(contentTypes, contentType)
+	}
+	if len(contentTypes) == 0 {
+		return ""
+	}
+	sort.Strings(contentTypes)
+	for _, contentType := range contentTypes {
+		if contentType == "application/json" {
+			return contentType
+		}
+	}
+	for _, contentType := range contentTypes {
+		if isJsonContentType(contentType) {
+			return contentType
+		}
+	}
+	return contentTypes[0]
+}
+
+func isJsonContentType(contentType string) bool {
+	return strings.Contains(contentType, "json")
+}
+
+// OpenApiSpec.makeBody encodes the example as JSON, string examples of other content types are used as is.
+func (spec *OpenApiSpec) makeBody(contentType string, mediaType *OpenApiMediaType) ([]byte, error) {
+	if mediaType == nil {
+		return []byte{}, nil
+	}
+	example, err := spec.getExample(mediaType)
+	if err != nil {
+		return nil, err
+	}
+	if example == nil {
+		return []byte{}, nil
+	}
+	s, isString := example.(string)
+	if isString && !isJsonContentType(contentType) {
+		return []byte(s), nil
+	}
+	return json.Marshal(example)
+}
+
+func (spec *OpenApiSpec) getExample(mediaType *OpenApiMediaType) (interface{}, error) {
+	if mediaType.Example != nil {
+		return mediaType.Example, nil
+	}
+	if len(mediaType.Examples) > 0 {
+		names := make([]string, 0)
+		for name := range mediaType.Examples {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if mediaType.Examples[names[0]] == nil {
+			return nil, fmt.Errorf("example <%s> is null", names[0])
+		}
+		example, err := spec.resolveExample(mediaType.Examples[names[0]])
+		if err != nil {
+			return nil, err
+		}
+		return example.Value, nil
+	}
+	if mediaType.Schema != nil {
+		return spec.sample(mediaType.Schema, 0)
+	}
+	return nil, nil
+}
+
+// OpenApiSpec.sample generates a value of the schema, examples and defaults of the schema are used when present.
+// A null schema (e.g. of a property) is sampled as null, the same as a schema without a type.
+func (spec *OpenApiSpec) sample(schema *OpenApiSchema, depth int) (interface{}, error) {
+	if schema == nil || depth > MAX_SCHEMA_DEPTH {
+		return nil, nil
+	}
+	if schema.Ref != "" {
+		resolved, err := spec.resolveSchema(schema)
+		if err != nil {
+			return nil, err
+		}
+		return spec.sample(resolved, depth+1)
+	}
+	switch {
+	case schema.Example != nil:
+		return schema.Example, nil
+	case len(schema.Examples) > 0:
+		return schema.Examples[0], nil
+	case schema.Default != nil:
+		return schema.Default, nil
+	case len(schema.Enum) > 0:
+		return schema.Enum[0], nil
+	case len(schema.AllOf) > 0:
+		return spec.sampleAllOf(schema.AllOf, depth)
+	case len(schema.OneOf) > 0:
+		return spec.sample(schema.OneOf[0], depth+1)
+	case len(schema.AnyOf) > 0:
+		return spec.sample(schema.AnyOf[0], depth+1)
+	}
+	switch schemaType := schema.getType(); {
+	case schemaType == "object" || schema.Properties != nil:
+		object := make(map[string]interface{})
+		for name, property := range schema.Properties {
+			value, err := spec.sample(property, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = value
+		}
+		return object, nil
+	case schemaType == "array" || schema.Items != nil:
+		array := make([]interface{}, 0)
+		if schema.Items != nil {
+			item, err := spec.sample(schema.Items, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, item)
+		}
+		return array, nil
+	case schemaType == "string":
+		s, found := SAMPLE_STRINGS[schema.Format]
+		if !found {
+			s = "string"
+		}
+		return s, nil
+	case schemaType == "integer", schemaType == "number":
+		return 0, nil
+	case schemaType == "boolean":
+		return true, nil
+	}
+	return nil, nil
+}
+
+// OpenApiSpec.sampleAllOf merges properties of all object schemas.
+func (spec *OpenApiSpec) sampleAllOf(schemas []*OpenApiSchema, depth int) (interface{}, error) {
+	merged := make(map[string]interface{})
+	var last interface{}
+	for _, schema := range schemas {
+		value, err := spec.sample(schema, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			last = value
+			continue
+		}
+		for name, value := range object {
+			merged[name] = value
+		}
+	}
+	if len(merged) == 0 && last != nil {
+		return last, nil
+	}
+	return merged, nil
+}
+
+// OpenApiSchema.getType returns the first non-null type.
+func (schema *OpenApiSchema) getType() string {
+	switch schemaType := schema.Type.(type) {
+	case string:
+		return schemaType
+	case []interface{}:
+		for _, item := range schemaType {
+			if item != "null" {
+				return fmt.Sprint(item)
+			}
+		}
+	}
+	return ""
+}
+
+func (spec *OpenApiSpec) resolveSchema(schema *OpenApiSchema) (*OpenApiSchema, error) {
+	name, err := parseRef(schema.Ref, "schemas")
+	if err != nil {
+		return nil, err
+	}
+	resolved, found := spec.Components.Schemas[name]
+	if !found {
+		return nil, fmt.Errorf("unknown $ref <%s>", schema.Ref)
+	}
+	return resolved, nil
+}
+
+func (spec *OpenApiSpec) resolveResponse(response *OpenApiResponse) (*OpenApiResponse, error) {
+	if response == nil || response.Ref == "" {
+		return response, nil
+	}
+	name, err := parseRef(response.Ref, "responses")
+	if err != nil {
+		return nil, err
+	}
+	resolved, found := spec.Components.Responses[name]
+	if !found {
+		return nil, fmt.Errorf("unknown $ref <%s>", response.Ref)
+	}
+	return resolved, nil
+}
+
+func (spec *OpenApiSpec) resolveExample(example *OpenApiExample) (*OpenApiExample, error) {
+	if example.Ref == "" {
+		return example, nil
+	}
+	name, err := parseRef(example.Ref, "examples")
+	if err != nil {
+		return nil, err
+	}
+	resolved, found := spec.Components.Examples[name]
+	if !found {
+		return nil, fmt.Errorf("unknown $ref <%s>", example.Ref)
+	}
+	if resolved == nil {
+		return nil, fmt.Errorf("example <%s> is null", example.Ref)
+	}
+	return resolved, nil
+}
+
+// parseRef returns NAME of #/components/KIND/NAME, refs to other files aren't supported.
+func parseRef(ref, kind string) (string, error) {
+	prefix := OPENAPI_REF_PREFIX + kind + "/"
+	if !strings.HasPrefix(ref, prefix) {
+		return "", fmt.Errorf("unsupported $ref <%s>, expecting %sNAME", ref, prefix)
+	}
+	return strings.TrimPrefix(ref, prefix), nil
+}
+
+// Server.importOpenApi saves endpoints made from the spec in the request body,
+// delay param is applied to all of them, replace param works the same as for bundles.
+func (server *Server) importOpenApi(site string, req *http.Request) (*SiteBundle, error) {
+	values := req.URL.Query()
+	replace, err := getBoolParam(values, REPLACE_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	delay, delayDistribution, err := server.getEndpointDelay(values)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := decodeOpenApiSpec(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := spec.toBundle(site, delay, delayDistribution)
+	if err != nil {
+		return nil, err
+	}
+	err = server.saveBundle(site, bundle, replace)
+	if err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// runOpenApiSubcommand saves endpoints made from the spec to SITE (the single site by default).
+func runOpenApiSubcommand(storage *Storage, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet(OPENAPI_COMMAND, flag.ContinueOnError)
+	rawDelay := flags.String(DELAY_PARAM, "0", "delay of all endpoints, see the delay query param")
+	replace := flags.Bool(REPLACE_PARAM, false, "delete endpoints of the site that aren't in the spec")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	delay, delayDistribution, err := parseDelay(*rawDelay)
+	if err != nil {
+		return err
+	}
+	spec, err := decodeOpenApiSpec(stdin)
+	if err != nil {
+		return err
+	}
+	site := EMPTY_SITE
+	if flags.NArg() > 0 {
+		site = flags.Arg(0)
+	}
+	bundle, err := spec.toBundle(site, delay, delayDistribution)
+	if err != nil {
+		return err
+	}
+	err = storage.ImportEndpoints(site, bundle.Endpoints, *replace)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "imported %d endpoints to site <%s>\n", len(bundle.Endpoints), site)
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	OUTAGE_PERIOD_SEPARATOR = "/"
+	OUTAGE_OFFSET_SEPARATOR = "@"
+	OUTAGE_DAILY_SEPARATOR  = "-"
+	OUTAGE_TIME_OF_DAY      = "15:04"
+	DAY                     = 24 * time.Hour
+)
+
+// OutageSchedule makes an endpoint respond with the outage Response during any of its Windows.
+type OutageSchedule struct {
+	Windows  []*OutageWindow
+	Response *Variant
+}
+
+// OutageWindow lasts Length every Period, starting at Offset into the period.
+// Periods are counted from the Unix epoch, so 30s every 5m is the first 30 seconds of 12:00, 12:05, 12:10, ...
+// and daily windows are in UTC.
+type OutageWindow struct {
+	Length time.Duration
+	Period time.Duration
+	Offset time.Duration `json:",omitempty"`
+}
+
+// parseOutageWindow parses LENGTH/PERIOD (30s/5m), LENGTH/PERIOD@OFFSET (30s/5m@1m),
+// or a daily window START-END in UTC (09:00-09:15). Bare numbers are seconds.
+func parseOutageWindow(rawWindow string) (*OutageWindow, error) {
+	rawWindow = strings.TrimSpace(rawWindow)
+	if !strings.Contains(rawWindow, OUTAGE_PERIOD_SEPARATOR) {
+		return parseDailyOutageWindow(rawWindow)
+	}
+	parts := strings.SplitN(rawWindow, OUTAGE_PERIOD_SEPARATOR, 2)
+	rawLength, rawPeriod, rawOffset := parts[0], parts[1], "0"
+	if strings.Contains(rawPeriod, OUTAGE_OFFSET_SEPARATOR) {
+		parts = strings.SplitN(rawPeriod, OUTAGE_OFFSET_SEPARATOR, 2)
+		rawPeriod, rawOffset = parts[0], parts[1]
+	}
+	window := &OutageWindow{}
+	var lengthErr, periodErr, offsetErr error
+	window.Length, lengthErr = parseInterval(strings.TrimSpace(rawLength))
+	window.Period, periodErr = parseInterval(strings.TrimSpace(rawPeriod))
+	window.Offset, offsetErr = parseInterval(strings.TrimSpace(rawOffset))
+	if lengthErr != nil || periodErr != nil || offsetErr != nil {
+		return nil, InvalidOutageError(rawWindow)
+	}
+	if window.Length <= 0 || window.Length > window.Period || window.Offset < 0 || window.Offset >= window.Period {
+		return nil, InvalidOutageError(rawWindow)
+	}
+	return window, nil
+}
+
+func parseDailyOutageWindow(rawWindow string) (*OutageWindow, error) {
+	parts := strings.SplitN(rawWindow, OUTAGE_DAILY_SEPARATOR, 2)
+	if len(parts) != 2 {
+		return nil, InvalidOutageError(rawWindow)
+	}
+	start, err := time.Parse(OUTAGE_TIME_OF_DAY, strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, InvalidOutageError(rawWindow)
+	}
+	end, err := time.Parse(OUTAGE_TIME_OF_DAY, strings.TrimSpace(parts[1]))
+	if err != nil || end.Equal(start) {
+		return nil, InvalidOutageError(rawWindow)
+	}
+	length := end.Sub(start)
+	if length < 0 { // e.g 23:50-00:10
+		length += DAY
+	}
+	midnight := time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &OutageWindow{Length: length, Period: DAY, Offset: start.Sub(midnight)}, nil
+}
+
+func (window *OutageWindow) IsActive(now time.Time) bool {
+	position := (now.UnixNano() - int64(window.Offset)) % int64(window.Period)
+	if position < 0 {
+		position += int64(window.Period)
+	}
+	return position < int64(window.Length)
+}
+
+func (window *OutageWindow) String() string {
+	if window.Period == DAY {
+		midnight := time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)
+		start := midnight.Add(window.Offset)
+		return fmt.Sprintf("daily %s-%s UTC",
+			start.Format(OUTAGE_TIME_OF_DAY), start.Add(window.Length).Format(OUTAGE_TIME_OF_DAY))
+	}
+	result := fmt.Sprintf("%s every %s", window.Length, window.Period)
+	if window.Offset != 0 {
+		result += fmt.Sprintf(" starting %s into the period", window.Offset)
+	}
+	return result
+}
+
+// OutageSchedule.IsActive returns true if any of the windows is active.
+func (schedule *OutageSchedule) IsActive(now time.Time) bool {
+	for _, window := range schedule.Windows {
+		if window.IsActive(now) {
+			return true
+		}
+	}
+	return false
+}
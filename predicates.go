@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Predicate sources.
+const (
+	QUERY_PREDICATE  = "query"
+	HEADER_PREDICATE = "header"
+	BODY_PREDICATE   = "body"
+)
+
+// Predicate kinds.
+const (
+	EQUALS_PREDICATE      = "equals"
+	PRESENT_PREDICATE     = "present"
+	REGEXP_PREDICATE      = "regexp"
+	CONTAINS_PREDICATE    = "contains"    // body only
+	JSON_EQUALS_PREDICATE = "json-equals" // body only
+	EMPTY_PREDICATE       = "empty"       // query only
+)
+
+const (
+	EQUALS_SEPARATOR      = "="
+	REGEXP_SEPARATOR      = "~"
+	JSON_EQUALS_SEPARATOR = "=="
+	JSON_PATH_ROOT        = "$"
+)
+
+// Predicate is an additional condition a request must satisfy to match an endpoint.
+// E.g. {Source: "query", Name: "q", Kind: "equals", Value: "goslow"} is satisfied by /search?q=goslow
+// and {Source: "body", Name: "$.user.id", Kind: "json-equals", Value: "42"} is satisfied by {"user": {"id": 42}}
+// {Source: "query", Kind: "empty"} is satisfied only by requests without query params.
+type Predicate struct {
+	Source string
+	Name   string
+	Kind   string
+	Value  string `json:",omitempty"`
+}
+
+// parsePredicate parses NAME (presence), NAME=VALUE (equality), or NAME~REGEXP.
+func parsePredicate(source, rawPredicate string) (*Predicate, error) {
+	predicate := &Predicate{Source: source, Name: rawPredicate, Kind: PRESENT_PREDICATE}
+	i := strings.IndexAny(rawPredicate, EQUALS_SEPARATOR+REGEXP_SEPARATOR)
+	if i != -1 {
+		predicate.Name = rawPredicate[:i]
+		predicate.Value = rawPredicate[i+1:]
+		if rawPredicate[i:i+1] == EQUALS_SEPARATOR {
+			predicate.Kind = EQUALS_PREDICATE
+		} else {
+			predicate.Kind = REGEXP_PREDICATE
+		}
+	}
+	if predicate.Name == "" {
+		return nil, InvalidPredicateError(rawPredicate, "name is empty")
+	}
+	if source == HEADER_PREDICATE {
+		predicate.Name = http.CanonicalHeaderKey(predicate.Name)
+	}
+	if predicate.Kind == REGEXP_PREDICATE {
+		_, err := compileRegexp(predicate.Value)
+		if err != nil {
+			return nil, InvalidPredicateError(rawPredicate, err.Error())
+		}
+	}
+	return predicate, nil
+}
+
+// parseBodyPredicate parses SUBSTRING for contains, REGEXP for regexp,
+// and JSON-PATH==JSON-VALUE (e.g. $.user.id==42) for json-equals predicates.
+func parseBodyPredicate(kind, rawPredicate string) (*Predicate, error) {
+	predicate := &Predicate{Source: BODY_PREDICATE, Kind: kind, Value: rawPredicate}
+	switch kind {
+	case REGEXP_PREDICATE:
+		_, err := compileRegexp(rawPredicate)
+		if err != nil {
+			return nil, InvalidPredicateError(rawPredicate, err.Error())
+		}
+	case JSON_EQUALS_PREDICATE:
+		parts := strings.SplitN(rawPredicate, JSON_EQUALS_SEPARATOR, 2)
+		if len(parts) != 2 {
+			return nil, InvalidPredicateError(rawPredicate, "expecting JSON-PATH==VALUE")
+		}
+		predicate.Name = strings.TrimSpace(parts[0])
+		predicate.Value = strings.TrimSpace(parts[1])
+		_, err := parseJsonPath(predicate.Name)
+		if err != nil {
+			return nil, InvalidPredicateError(rawPredicate, err.Error())
+		}
+	}
+	return predicate, nil
+}
+
+func (predicate *Predicate) Matches(req *http.Request) bool {
+	var values []string
+	var present bool
+	switch predicate.Source {
+	case QUERY_PREDICATE:
+		if predicate.Kind == EMPTY_PREDICATE {
+			return req.URL.RawQuery == ""
+		}
+		values, present = req.URL.Query()[predicate.Name]
+	case HEADER_PREDICATE:
+		values, present = req.Header[predicate.Name]
+	case BODY_PREDICATE:
+		return predicate.matchesBody(req)
+	default:
+		return false
+	}
+	if predicate.Kind == PRESENT_PREDICATE {
+		return present
+	}
+	for _, value := range values {
+		if predicate.matchesValue(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (predicate *Predicate) matchesValue(value string) bool {
+	switch predicate.Kind {
+	case EQUALS_PREDICATE:
+		return value == predicate.Value
+	case REGEXP_PREDICATE:
+		re, err := compileRegexp(predicate.Value)
+		return err == nil && re.MatchString(value)
+	case CONTAINS_PREDICATE:
+		return strings.Contains(value, predicate.Value)
+	}
+	return false
+}
+
+func (predicate *Predicate) matchesBody(req *http.Request) bool {
+	if predicate.Kind != JSON_EQUALS_PREDICATE {
+		body, err := peekBody(req)
+		return err == nil && predicate.matchesValue(string(body))
+	}
+	document, err := peekJSON(req)
+	if err != nil {
+		return false
+	}
+	path, err := parseJsonPath(predicate.Name)
+	if err != nil {
+		return false
+	}
+	actual, found := lookupJsonPath(document, path)
+	return found && reflect.DeepEqual(actual, parseJsonValue(predicate.Value))
+}
+
+// parseJsonValue parses 42, "bob", true, null, etc. Invalid JSON is treated as a string,
+// so $.user.name==bob works without quotes.
+func parseJsonValue(rawValue string) interface{} {
+	var value interface{}
+	err := json.Unmarshal([]byte(rawValue), &value)
+	if err != nil {
+		return rawValue
+	}
+	return value
+}
+
+// parseJsonPath parses a simple JSON path like $.users[0].id into ["users", 0, "id"].
+// Object keys are strings, array indexes are ints.
+func parseJsonPath(jsonPath string) ([]interface{}, error) {
+	if !strings.HasPrefix(jsonPath, JSON_PATH_ROOT) {
+		return nil, fmt.Errorf("JSON path should start with %s", JSON_PATH_ROOT)
+	}
+	path := make([]interface{}, 0)
+	rest := jsonPath[len(JSON_PATH_ROOT):]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("empty key in JSON path %s", jsonPath)
+			}
+			path = append(path, rest[1:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("unclosed [ in JSON path %s", jsonPath)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("bad index in JSON path %s", jsonPath)
+			}
+			path = append(path, index)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q in JSON path %s", rest[0], jsonPath)
+		}
+	}
+	return path, nil
+}
+
+func lookupJsonPath(document interface{}, path []interface{}) (interface{}, bool) {
+	for _, step := range path {
+		switch key := step.(type) {
+		case string:
+			object, isObject := document.(map[string]interface{})
+			if !isObject {
+				return nil, false
+			}
+			value, found := object[key]
+			if !found {
+				return nil, false
+			}
+			document = value
+		case int:
+			array, isArray := document.([]interface{})
+			if !isArray || key < 0 || key >= len(array) {
+				return nil, false
+			}
+			document = array[key]
+		}
+	}
+	return document, true
+}
+
+func (predicate *Predicate) String() string {
+	switch predicate.Kind {
+	case EQUALS_PREDICATE:
+		return fmt.Sprintf("%s %s%s%s", predicate.Source, predicate.Name, EQUALS_SEPARATOR, predicate.Value)
+	case REGEXP_PREDICATE:
+		return fmt.Sprintf("%s %s%s%s", predicate.Source, predicate.Name, REGEXP_SEPARATOR, predicate.Value)
+	case CONTAINS_PREDICATE:
+		return fmt.Sprintf("%s containing %s", predicate.Source, predicate.Value)
+	case JSON_EQUALS_PREDICATE:
+		return fmt.Sprintf("%s %s%s%s", predicate.Source, predicate.Name, JSON_EQUALS_SEPARATOR, predicate.Value)
+	case EMPTY_PREDICATE:
+		return fmt.Sprintf("empty %s", predicate.Source)
+	}
+	return fmt.Sprintf("%s %s", predicate.Source, predicate.Name)
+}
+
+func matchesAll(predicates []*Predicate, req *http.Request) bool {
+	for _, predicate := range predicates {
+		if !predicate.Matches(req) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortPredicates gives the same predicates the same order,
+// because predicates are a part of the endpoint primary key.
+func sortPredicates(predicates []*Predicate) {
+	sort.Slice(predicates, func(i, j int) bool {
+		return predicates[i].String() < predicates[j].String()
+	})
+}
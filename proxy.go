@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_PROXY_ERROR_STATUS_CODE = http.StatusBadGateway
+	PROXY_ERROR_RESPONSE            = "goslow: injected upstream error\n"
+)
+
+var UNRECORDED_HEADERS = []string{"Content-Length", "Date", "Connection", "Transfer-Encoding",
+	"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Allow-Headers"}
+
+// Site is a group of endpoints sharing the same domain.
+// If Upstream is not empty, then requests not matching any endpoint are proxied to it:
+// after Delay, at most BytesPerSecond fast, and ErrorRate (from 0 to 1) of them fail with ErrorStatusCode
+// without reaching the upstream.
+// If Record is true, then proxied responses are saved as endpoints, see recordingWriter.Endpoint.
+type Site struct {
+	Name            string
+	Upstream        string
+	Delay           time.Duration
+	BytesPerSecond  int
+	ErrorRate       float64
+	ErrorStatusCode int
+	Record          bool
+}
+
+func (site *Site) IsProxy() bool {
+	return site.Upstream != ""
+}
+
+// parseUpstream accepts absolute http and https URLs, empty upstream turns off the proxy.
+// Unless allowPrivate is true, the upstream host should resolve to public addresses only (see isPrivateIP).
+func parseUpstream(rawUpstream string, allowPrivate bool) (string, error) {
+	if rawUpstream == "" {
+		return "", nil
+	}
+	upstream, err := url.Parse(rawUpstream)
+	if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+		return "", InvalidUpstreamError(rawUpstream)
+	}
+	if allowPrivate {
+		return rawUpstream, nil
+	}
+	ips, err := net.LookupIP(upstream.Hostname())
+	if err != nil {
+		return "", UnresolvableUpstreamError(rawUpstream, err)
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return "", PrivateUpstreamError(rawUpstream, ip)
+		}
+	}
+	return rawUpstream, nil
+}
+
+// isPrivateIP is true for loopback, private, link-local and unspecified addresses,
+// a shared instance shouldn't let its users reach them.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified()
+}
+
+// newUpstreamTransport returns the transport of proxied requests.
+// Unless allowPrivate is true, it refuses to connect to private addresses,
+// so an upstream host can't be pointed to them after parseUpstream has checked it.
+func newUpstreamTransport(allowPrivate bool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if allowPrivate {
+		return transport
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refusePrivateAddress}
+	transport.DialContext = dialer.DialContext
+	// HTTP_PROXY would make the dialer check the address of the proxy instead of the upstream one
+	transport.Proxy = nil
+	return transport
+}
+
+// refusePrivateAddress is called with the resolved address right before connecting to it.
+func refusePrivateAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivateIP(ip) {
+		return fmt.Errorf("refusing to connect to the private address %s", address)
+	}
+	return nil
+}
+
+// proxyTo forwards the request to the site upstream using the transport, Host header is rewritten to the upstream host.
+// If the site is recording, then it returns the endpoint made from the upstream response.
+// Injected errors and failed requests to the upstream aren't recorded.
+func proxyTo(site *Site, transport http.RoundTripper, random Random, w http.ResponseWriter,
+	req *http.Request) (*Endpoint, error) {
+	upstream, err := url.Parse(site.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(site.Delay)
+	if random.Float64() < site.ErrorRate {
+		w.WriteHeader(site.ErrorStatusCode)
+		w.Write([]byte(PROXY_ERROR_RESPONSE))
+		return nil, nil
+	}
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.Transport = transport
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = upstream.Host
+	}
+	var recorder *recordingWriter
+	if site.Record {
+		// the upstream consumes the request body, the recorded endpoint needs a copy of it
+		requestBody, err := peekBody(req)
+		if err != nil {
+			return nil, err
+		}
+		recorder = &recordingWriter{ResponseWriter: w, requestBody: requestBody}
+		w = recorder
+		proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("error: can't proxy to %s: %s", site.Upstream, err)
+			recorder.failed = true
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+	if site.BytesPerSecond > 0 {
+		w = &throttledWriter{ResponseWriter: w, endpoint: &Endpoint{BytesPerSecond: site.BytesPerSecond}}
+	}
+	proxy.ServeHTTP(w, req)
+	if recorder == nil || recorder.failed {
+		return nil, nil
+	}
+	return recorder.Endpoint(site.Name, req), nil
+}
+
+// recordingWriter keeps a copy of the response.
+type recordingWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	body        bytes.Buffer
+	failed      bool
+	requestBody []byte
+}
+
+func (w *recordingWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingWriter) Write(body []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.body.Write(body)
+	return w.ResponseWriter.Write(body)
+}
+
+func (w *recordingWriter) Flush() {
+	flush(w.ResponseWriter)
+}
+
+// recordingWriter.Endpoint returns the endpoint responding to the same method, path, query params and body
+// with the recorded response. Requests without query params are recorded with the empty query predicate,
+// so they don't shadow the requests with params. Headers that are set by goslow itself aren't recorded.
+func (w *recordingWriter) Endpoint(site string, req *http.Request) *Endpoint {
+	predicates := make([]*Predicate, 0)
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			predicates = append(predicates, &Predicate{Source: QUERY_PREDICATE, Name: name,
+				Kind: EQUALS_PREDICATE, Value: value})
+		}
+	}
+	if req.URL.RawQuery == "" {
+		predicates = append(predicates, &Predicate{Source: QUERY_PREDICATE, Kind: EMPTY_PREDICATE})
+	}
+	if len(w.requestBody) > 0 {
+		predicates = append(predicates, &Predicate{Source: BODY_PREDICATE, Kind: EQUALS_PREDICATE,
+			Value: string(w.requestBody)})
+	}
+	sortPredicates(predicates)
+	headers := make(http.Header)
+	addHeaders(w.Header(), headers)
+	for _, header := range UNRECORDED_HEADERS {
+		headers.Del(header)
+	}
+	return &Endpoint{
+		Site:       site,
+		Path:       escapeGlob(req.URL.Path),
+		Method:     req.Method,
+		Predicates: predicates,
+		Headers:    headers,
+		StatusCode: w.statusCode,
+		Response:   w.body.Bytes(),
+		Weight:     DEFAULT_WEIGHT,
+	}
+}
+
+// throttledWriter writes at most endpoint.BytesPerSecond fast, see writeBody.
+type throttledWriter struct {
+	http.ResponseWriter
+	endpoint *Endpoint
+}
+
+func (w *throttledWriter) Write(body []byte) (int, error) {
+	err := writeBody(w.endpoint, body, w.ResponseWriter)
+	if err != nil {
+		return 0, err
+	}
+	return len(body), nil
+}
+
+func (w *throttledWriter) Flush() {
+	flush(w.ResponseWriter)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Random is the part of *rand.Rand used to sample delays and to choose responses.
+type Random interface {
+	Float64() float64
+	NormFloat64() float64
+	ExpFloat64() float64
+}
+
+// GLOBAL_RANDOM is used by endpoints without a seed.
+var GLOBAL_RANDOM Random = globalRandom{}
+
+// globalRandom uses the top-level math/rand functions, which are safe for concurrent use.
+type globalRandom struct{}
+
+func (globalRandom) Float64() float64     { return rand.Float64() }
+func (globalRandom) NormFloat64() float64 { return rand.NormFloat64() }
+func (globalRandom) ExpFloat64() float64  { return rand.ExpFloat64() }
+
+// lockedRandom is a seeded *rand.Rand safe for concurrent use.
+type lockedRandom struct {
+	sync.Mutex
+	random *rand.Rand
+}
+
+func newLockedRandom(seed int64) *lockedRandom {
+	return &lockedRandom{random: rand.New(rand.NewSource(seed))}
+}
+
+func (random *lockedRandom) Float64() float64 {
+	random.Lock()
+	defer random.Unlock()
+	return random.random.Float64()
+}
+
+func (random *lockedRandom) NormFloat64() float64 {
+	random.Lock()
+	defer random.Unlock()
+	return random.random.NormFloat64()
+}
+
+func (random *lockedRandom) ExpFloat64() float64 {
+	random.Lock()
+	defer random.Unlock()
+	return random.random.ExpFloat64()
+}
+
+// RandomSources keeps a seeded random source per endpoint, so the n-th request
+// to an endpoint with a seed gets the same random values in every test run.
+type RandomSources struct {
+	sync.Mutex
+	sources map[string]*lockedRandom
+}
+
+func NewRandomSources() *RandomSources {
+	return &RandomSources{sources: make(map[string]*lockedRandom)}
+}
+
+// RandomSources.For returns GLOBAL_RANDOM for endpoints without a seed.
+func (sources *RandomSources) For(endpoint *Endpoint) Random {
+	if endpoint.Seed == nil {
+		return GLOBAL_RANDOM
+	}
+	sources.Lock()
+	defer sources.Unlock()
+	key := endpoint.Key()
+	source, found := sources.sources[key]
+	if !found {
+		source = newLockedRandom(*endpoint.Seed)
+		sources.sources[key] = source
+	}
+	return source
+}
+
+// RandomSources.Reset starts the sequence of random values from the beginning.
+// It's called when the endpoint is saved.
+func (sources *RandomSources) Reset(endpoint *Endpoint) {
+	sources.Lock()
+	defer sources.Unlock()
+	delete(sources.sources, endpoint.Key())
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RATE_LIMIT_SEPARATOR     = "/"
+	IP_RATE_LIMIT_KEY        = "ip"      // every client IP has its own limit
+	HEADER_RATE_LIMIT_PREFIX = "header:" // e.g header:X-Api-Key, every header value has its own limit
+	DEFAULT_RATE_LIMIT_BODY  = "Too Many Requests"
+	MAX_RATE_LIMIT_WINDOWS   = 10000 // expired windows are forgotten when there are more windows than this
+)
+
+// RateLimit allows Requests per Interval. Limit is a fixed window starting at the first request.
+// Empty Key means that all clients share the same limit.
+type RateLimit struct {
+	Requests int
+	Interval time.Duration
+	Key      string `json:",omitempty"`
+	Response []byte `json:",omitempty"`
+}
+
+// parseRateLimit parses REQUESTS/INTERVAL, e.g 10/60, 10/1m, or 10/500ms. Bare numbers are seconds.
+func parseRateLimit(rawRateLimit, key string, response []byte) (*RateLimit, error) {
+	parts := strings.SplitN(rawRateLimit, RATE_LIMIT_SEPARATOR, 2)
+	if len(parts) != 2 {
+		return nil, InvalidRateLimitError(rawRateLimit)
+	}
+	requests, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || requests <= 0 {
+		return nil, InvalidRateLimitError(rawRateLimit)
+	}
+	interval, err := parseInterval(strings.TrimSpace(parts[1]))
+	if err != nil || interval <= 0 {
+		return nil, InvalidRateLimitError(rawRateLimit)
+	}
+	if key != "" && key != IP_RATE_LIMIT_KEY &&
+		(!strings.HasPrefix(key, HEADER_RATE_LIMIT_PREFIX) || key == HEADER_RATE_LIMIT_PREFIX) {
+		return nil, InvalidRateLimitKeyError(key)
+	}
+	if strings.HasPrefix(key, HEADER_RATE_LIMIT_PREFIX) {
+		key = HEADER_RATE_LIMIT_PREFIX + http.CanonicalHeaderKey(strings.TrimPrefix(key, HEADER_RATE_LIMIT_PREFIX))
+	}
+	if len(response) == 0 {
+		response = []byte(DEFAULT_RATE_LIMIT_BODY)
+	}
+	return &RateLimit{Requests: requests, Interval: interval, Key: key, Response: response}, nil
+}
+
+// parseInterval parses seconds (60) or a Go duration (1m), unlike parseDelayValue it has no upper bound.
+func parseInterval(rawInterval string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(rawInterval, 64)
+	if err == nil {
+		return secondsToDuration(seconds), nil
+	}
+	return time.ParseDuration(rawInterval)
+}
+
+// RateLimit.clientKey returns the part of the request that identifies a client.
+func (limit *RateLimit) clientKey(req *http.Request) string {
+	switch {
+	case limit.Key == IP_RATE_LIMIT_KEY:
+		return getRealIP(req)
+	case strings.HasPrefix(limit.Key, HEADER_RATE_LIMIT_PREFIX):
+		return req.Header.Get(strings.TrimPrefix(limit.Key, HEADER_RATE_LIMIT_PREFIX))
+	}
+	return ""
+}
+
+func (limit *RateLimit) String() string {
+	result := fmt.Sprintf("%d requests per %s", limit.Requests, limit.Interval)
+	if limit.Key != "" {
+		result += " per " + limit.Key
+	}
+	return result
+}
+
+// RateLimitStatus is the state of the client limit after the request.
+type RateLimitStatus struct {
+	Allowed   bool
+	Remaining int
+	Reset     time.Time // when the current window ends
+}
+
+type rateWindow struct {
+	start    time.Time
+	interval time.Duration // windows of different endpoints have different intervals
+	count    int
+}
+
+func (window *rateWindow) isExpired(now time.Time) bool {
+	return !now.Before(window.start.Add(window.interval))
+}
+
+// RateLimiter keeps the current window of every endpoint and client.
+type RateLimiter struct {
+	sync.Mutex
+	windows map[string]*rateWindow
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{windows: make(map[string]*rateWindow)}
+}
+
+// RateLimiter.Take counts the request against the limit of the endpoint.
+// Rejected requests are counted too, so clients ignoring Retry-After stay limited until the window ends.
+func (limiter *RateLimiter) Take(endpoint *Endpoint, req *http.Request, now time.Time) *RateLimitStatus {
+	limit := endpoint.RateLimit
+	key := endpoint.Key() + "\x00" + limit.clientKey(req)
+	limiter.Lock()
+	defer limiter.Unlock()
+	window, found := limiter.windows[key]
+	if !found || window.isExpired(now) {
+		limiter.forgetExpiredWindows(now)
+		window = &rateWindow{start: now, interval: limit.Interval}
+		limiter.windows[key] = window
+	}
+	window.count++
+	return &RateLimitStatus{
+		Allowed:   window.count <= limit.Requests,
+		Remaining: maxInt(limit.Requests-window.count, 0),
+		Reset:     window.start.Add(limit.Interval),
+	}
+}
+
+// forgetExpiredWindows keeps memory bounded when clients come and go.
+// Window is considered expired if it's older than the interval of its endpoint.
+func (limiter *RateLimiter) forgetExpiredWindows(now time.Time) {
+	if len(limiter.windows) < MAX_RATE_LIMIT_WINDOWS {
+		return
+	}
+	for key, window := range limiter.windows {
+		if window.isExpired(now) {
+			delete(limiter.windows, key)
+		}
+	}
+}
+
+// RateLimiter.Reset forgets the windows of all clients of the endpoint.
+// It's called when the endpoint is saved.
+func (limiter *RateLimiter) Reset(endpoint *Endpoint) {
+	prefix := endpoint.Key() + "\x00"
+	limiter.Lock()
+	defer limiter.Unlock()
+	for key := range limiter.windows {
+		if strings.HasPrefix(key, prefix) {
+			delete(limiter.windows, key)
+		}
+	}
+}
+
+// Endpoint.rejectedByRateLimit returns 429 with the rate limit response without any delay.
+func (endpoint *Endpoint) rejectedByRateLimit() *Endpoint {
+	return &Endpoint{
+		Site:       endpoint.Site,
+		Path:       endpoint.Path,
+		Method:     endpoint.Method,
+		Predicates: endpoint.Predicates,
+		StatusCode: http.StatusTooManyRequests,
+		Response:   endpoint.RateLimit.Response,
+	}
+}
+
+// Endpoint.withRateLimitHeaders returns a copy of the endpoint with X-RateLimit-* headers,
+// rejected requests also get the Retry-After header.
+func (endpoint *Endpoint) withRateLimitHeaders(limit *RateLimit, status *RateLimitStatus, now time.Time) *Endpoint {
+	headers := make(http.Header)
+	addHeaders(endpoint.Headers, headers)
+	headers.Set("X-RateLimit-Limit", strconv.Itoa(limit.Requests))
+	headers.Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	headers.Set("X-RateLimit-Reset", strconv.FormatInt(status.Reset.Unix(), 10))
+	if !status.Allowed {
+		retryAfter := int(math.Ceil(status.Reset.Sub(now).Seconds()))
+		headers.Set("Retry-After", strconv.Itoa(maxInt(retryAfter, 1)))
+	}
+	copy := *endpoint
+	copy.Headers = headers
+	return &copy
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+)
+
+// Response modes.
+const (
+	STATIC_MODE   = ""         // response is sent as is (with regexp captures expanded)
+	TEMPLATE_MODE = "template" // response is a text/template executed with RequestData
+	ECHO_MODE     = "echo"     // response is EchoData of the request
+)
+
+var MODES = []string{TEMPLATE_MODE, ECHO_MODE}
+
+func isMode(mode string) bool {
+	for _, knownMode := range MODES {
+		if mode == knownMode {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestData is the dot of response templates, e.g {{ .Query.id }} or {{ .JSON.user.name }}.
+// Query and Headers have the first value of every param and header.
+// Captures are named and numbered groups of the regexp path, JSON is nil if the body isn't JSON.
+// Count is the number of the request to the endpoint starting with 1.
+type RequestData struct {
+	Method   string
+	Path     string
+	Query    map[string]string
+	Headers  map[string]string
+	Captures map[string]string
+	Body     string
+	JSON     interface{}
+	Count    int
+	Now      time.Time
+}
+
+func makeRequestData(endpoint *Endpoint, req *http.Request) (*RequestData, error) {
+	body, err := peekBody(req)
+	if err != nil {
+		return nil, err
+	}
+	document, _ := peekJSON(req)
+	data := &RequestData{
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Query:    make(map[string]string),
+		Headers:  make(map[string]string),
+		Captures: endpoint.Captures(req),
+		Body:     string(body),
+		JSON:     document,
+	}
+	for name, values := range req.URL.Query() {
+		data.Query[name] = values[0]
+	}
+	for name, values := range req.Header {
+		data.Headers[name] = values[0]
+	}
+	return data, nil
+}
+
+// Endpoint.Captures returns named and numbered groups captured by the regexp path.
+func (endpoint *Endpoint) Captures(req *http.Request) map[string]string {
+	captures := make(map[string]string)
+	if !endpoint.PathIsRegexp {
+		return captures
+	}
+	re, err := compileRegexp(endpoint.Path)
+	if err != nil {
+		return captures
+	}
+	submatches := re.FindStringSubmatch(req.URL.Path)
+	for i, name := range re.SubexpNames() {
+		if i == 0 || i >= len(submatches) {
+			continue
+		}
+		captures[fmt.Sprint(i)] = submatches[i]
+		if name != "" {
+			captures[name] = submatches[i]
+		}
+	}
+	return captures
+}
+
+// responseTemplateFuncs use the random source of the endpoint, so seeded endpoints render the same values.
+func responseTemplateFuncs(random Random) template.FuncMap {
+	return template.FuncMap{
+		"uuid": func() string {
+			return newUUID(random)
+		},
+		// randInt returns a random int in [min, max]
+		"randInt": func(min, max int) int {
+			return min + int(random.Float64()*float64(max-min+1))
+		},
+		"randFloat": random.Float64,
+		"json": func(value interface{}) (string, error) {
+			js, err := json.Marshal(value)
+			return string(js), err
+		},
+	}
+}
+
+func parseResponseTemplate(response []byte, random Random) (*template.Template, error) {
+	return template.New("response").Funcs(responseTemplateFuncs(random)).Parse(string(response))
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID(random Random) string {
+	uuid := make([]byte, 16)
+	for i := range uuid {
+		uuid[i] = byte(random.Float64() * 256)
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40 // version 4
+	uuid[8] = uuid[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// Endpoint.RenderResponse executes the response template.
+func (endpoint *Endpoint) RenderResponse(data *RequestData, random Random) ([]byte, error) {
+	tmpl, err := parseResponseTemplate(endpoint.Response, random)
+	if err != nil {
+		return nil, ResponseTemplateError(err)
+	}
+	var response bytes.Buffer
+	err = tmpl.Execute(&response, data)
+	if err != nil {
+		return nil, ResponseTemplateError(err)
+	}
+	return response.Bytes(), nil
+}
+
+// EchoData is a JSON description of the request, JSON is nil if the body isn't JSON.
+type EchoData struct {
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Query    url.Values  `json:"query"`
+	Headers  http.Header `json:"headers"`
+	Body     string      `json:"body"`
+	JSON     interface{} `json:"json"`
+	ClientIP string      `json:"client_ip"`
+	Host     string      `json:"host"`
+	Protocol string      `json:"protocol"`
+}
+
+// echoRequest returns the indented EchoData of the request.
+func echoRequest(req *http.Request) ([]byte, error) {
+	body, err := peekBody(req)
+	if err != nil {
+		return nil, err
+	}
+	document, _ := peekJSON(req)
+	echo := &EchoData{
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Query:    req.URL.Query(),
+		Headers:  req.Header,
+		Body:     string(body),
+		JSON:     document,
+		ClientIP: getRealIP(req),
+		Host:     req.Host,
+		Protocol: req.Proto,
+	}
+	response, err := json.MarshalIndent(echo, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(response, '\n'), nil
+}
+
+// Endpoint.checkResponseTemplates checks that the response is a valid template,
+// responses of variants, steps and outages are static (see Endpoint.withVariant).
+func (endpoint *Endpoint) checkResponseTemplates() error {
+	_, err := parseResponseTemplate(endpoint.Response, GLOBAL_RANDOM)
+	if err != nil {
+		return InvalidResponseTemplateError(err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_LOGGED_REQUESTS = 0 // per site, the request log is opt-in
+	REDACTED_HEADER_VALUE       = "[redacted]"
+)
+
+// Values of CREDENTIAL_HEADERS aren't logged, so they don't leak through the request log of a shared instance.
+var CREDENTIAL_HEADERS = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// LoggedRequest is a request received by a site.
+// Endpoint describes the matched endpoint and is empty if there was no matching endpoint.
+// Delay is in nanoseconds.
+type LoggedRequest struct {
+	Id       int64         `json:"id"`
+	Site     string        `json:"-"`
+	Method   string        `json:"method"`
+	Path     string        `json:"path"`
+	Query    url.Values    `json:"query"`
+	Headers  http.Header   `json:"headers"`
+	Body     string        `json:"body"`
+	Endpoint string        `json:"endpoint"`
+	Delay    time.Duration `json:"delay"`
+	Time     time.Time     `json:"time"`
+}
+
+func newLoggedRequest(site string, req *http.Request, endpoint *Endpoint, delay time.Duration,
+	now time.Time) (*LoggedRequest, error) {
+	body, err := peekBody(req)
+	if err != nil {
+		return nil, err
+	}
+	logged := &LoggedRequest{
+		Site:    site,
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Query:   req.URL.Query(),
+		Headers: redactCredentials(req.Header),
+		Body:    string(body),
+		Delay:   delay,
+		Time:    now,
+	}
+	if endpoint != nil {
+		logged.Endpoint = endpoint.String()
+	}
+	return logged, nil
+}
+
+// redactCredentials returns a copy of the headers with the values of CREDENTIAL_HEADERS redacted,
+// so expectations can still check that they're present.
+func redactCredentials(headers http.Header) http.Header {
+	redacted := make(http.Header)
+	addHeaders(headers, redacted)
+	for _, name := range CREDENTIAL_HEADERS {
+		if _, found := redacted[name]; found {
+			redacted[name] = []string{REDACTED_HEADER_VALUE}
+		}
+	}
+	return redacted
+}
+
+// RequestFilter selects logged requests, empty Method and Path match any request.
+// Path is a glob pattern (see matchesPath). Limit keeps only the latest requests if positive.
+type RequestFilter struct {
+	Method string
+	Path   string
+	Limit  int
+}
+
+// RequestFilter.Apply keeps the order of requests.
+func (filter *RequestFilter) Apply(requests []*LoggedRequest) []*LoggedRequest {
+	filtered := make([]*LoggedRequest, 0)
+	for _, request := range requests {
+		if matches(filter.Method, request.Method) && matchesPath(filter.Path, request.Path) {
+			filtered = append(filtered, request)
+		}
+	}
+	if filter.Limit > 0 && len(filtered) > filter.Limit {
+		filtered = filtered[len(filtered)-filter.Limit:]
+	}
+	return filtered
+}
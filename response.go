@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_CHUNK_SIZE = 1024 // bytes
+)
+
+// Network faults.
+const (
+	NO_FAULT                   = ""
+	RESET_FAULT                = "reset"                // TCP RST instead of a response
+	HANG_FAULT                 = "hang"                 // never answer
+	TRUNCATE_FAULT             = "truncate"             // close the connection in the middle of the body
+	CLOSE_BEFORE_HEADERS_FAULT = "close-before-headers" // close the connection without a response
+)
+
+var FAULTS = []string{RESET_FAULT, HANG_FAULT, TRUNCATE_FAULT, CLOSE_BEFORE_HEADERS_FAULT}
+
+func isFault(fault string) bool {
+	for _, knownFault := range FAULTS {
+		if fault == knownFault {
+			return true
+		}
+	}
+	return false
+}
+
+// respondWith sleeps for the given delay before the status line, for BodyDelay between the headers and the body,
+// and for StallDelay after StallOffset bytes of the body, flushing before every sleep.
+func respondWith(endpoint *Endpoint, delay time.Duration, w http.ResponseWriter) {
+	time.Sleep(delay)
+	if endpoint.Fault != NO_FAULT {
+		err := respondWithFault(endpoint, w)
+		if err != nil {
+			log.Printf("error: can't respond with fault %s: %s", endpoint.Fault, err)
+		}
+		return
+	}
+	addHeaders(endpoint.Headers, w.Header())
+	if endpoint.isStreamed() {
+		// client should know that the body is incomplete while it's trickling or stalling
+		w.Header().Set("Content-Length", strconv.Itoa(len(endpoint.Response)))
+	}
+	w.WriteHeader(endpoint.StatusCode)
+	if endpoint.BodyDelay > 0 {
+		flush(w)
+		time.Sleep(endpoint.BodyDelay)
+	}
+	if endpoint.StallDelay <= 0 {
+		writeBody(endpoint, endpoint.Response, w)
+		return
+	}
+	stallOffset := minInt(endpoint.StallOffset, len(endpoint.Response))
+	err := writeBody(endpoint, endpoint.Response[:stallOffset], w)
+	if err != nil {
+		return
+	}
+	flush(w)
+	time.Sleep(endpoint.StallDelay)
+	writeBody(endpoint, endpoint.Response[stallOffset:], w)
+}
+
+func (endpoint *Endpoint) isStreamed() bool {
+	return endpoint.BytesPerSecond > 0 || endpoint.BodyDelay > 0 || endpoint.StallDelay > 0
+}
+
+// respondWithFault takes over the connection, so nothing can be written to w after that.
+func respondWithFault(endpoint *Endpoint, w http.ResponseWriter) error {
+	hijacker, canHijack := w.(http.Hijacker)
+	if !canHijack {
+		return fmt.Errorf("connection doesn't support hijacking")
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	switch endpoint.Fault {
+	case RESET_FAULT:
+		tcpConn, isTCP := conn.(*net.TCPConn)
+		if isTCP {
+			tcpConn.SetLinger(0) // Close() sends RST instead of FIN
+		}
+	case HANG_FAULT:
+		// wait until the client gives up, but not forever
+		conn.SetReadDeadline(time.Now().Add(MAX_DELAY))
+		io.Copy(ioutil.Discard, conn)
+	case TRUNCATE_FAULT:
+		return writeTruncatedResponse(endpoint, buf)
+	}
+	return nil
+}
+
+// writeTruncatedResponse promises len(Response) bytes in the Content-Length,
+// but sends only StallOffset bytes (half of the response by default).
+func writeTruncatedResponse(endpoint *Endpoint, buf *bufio.ReadWriter) error {
+	header := make(http.Header)
+	addHeaders(endpoint.Headers, header)
+	header.Set("Content-Length", strconv.Itoa(len(endpoint.Response)))
+	sentLength := endpoint.StallOffset
+	if sentLength >= len(endpoint.Response) {
+		sentLength = len(endpoint.Response) / 2
+	}
+
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", endpoint.StatusCode, http.StatusText(endpoint.StatusCode))
+	header.Write(buf)
+	fmt.Fprint(buf, "\r\n")
+	buf.Write(endpoint.Response[:sentLength])
+	return buf.Flush()
+}
+
+func addHeaders(headers http.Header, responseHeader http.Header) {
+	for header, values := range headers {
+		for _, value := range values {
+			responseHeader.Add(header, value)
+		}
+	}
+}
+
+// writeBody writes the body at most BytesPerSecond fast in chunks, flushing every chunk.
+// It returns an error if the client has gone away.
+func writeBody(endpoint *Endpoint, body []byte, w http.ResponseWriter) error {
+	if endpoint.BytesPerSecond <= 0 {
+		_, err := w.Write(body)
+		return err
+	}
+	chunkSize := endpoint.getChunkSize()
+	start := time.Now()
+	for written := 0; written < len(body); {
+		chunk := body[written:minInt(written+chunkSize, len(body))]
+		// sleep until the time when the whole chunk would be transferred at the given bandwidth
+		time.Sleep(time.Until(start.Add(bytesToDuration(written+len(chunk), endpoint.BytesPerSecond))))
+		_, err := w.Write(chunk)
+		if err != nil {
+			return err
+		}
+		flush(w)
+		written += len(chunk)
+	}
+	return nil
+}
+
+// Endpoint.getChunkSize defaults to DEFAULT_CHUNK_SIZE, but chunks are sent at least once a second.
+func (endpoint *Endpoint) getChunkSize() int {
+	if endpoint.ChunkSize > 0 {
+		return endpoint.ChunkSize
+	}
+	return minInt(DEFAULT_CHUNK_SIZE, endpoint.BytesPerSecond)
+}
+
+func bytesToDuration(bytes, bytesPerSecond int) time.Duration {
+	return time.Duration(int64(bytes) * int64(time.Second) / int64(bytesPerSecond))
+}
+
+func flush(w http.ResponseWriter) {
+	flusher, canFlush := w.(http.Flusher)
+	if canFlush {
+		flusher.Flush()
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -4,6 +4,7 @@ package main
 // TODO: rename domain -> site where appropriate
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/alexandershov/go-hashids"
 	"io/ioutil"
@@ -44,7 +45,7 @@ const (
 )
 
 var (
-	EMPTY_HEADERS = map[string]string{}
+	EMPTY_HEADERS = http.Header{}
 )
 
 const (
@@ -52,16 +53,80 @@ const (
 	GOSLOW_LAUNCH_TIMESTAMP         = 1417447141 // December 1, 2014 18:19:01
 )
 
+// Admin actions, endpoint is created if there's no action.
 const (
-	DELAY_PARAM       = "delay"
-	STATUS_CODE_PARAM = "status"
-	METHOD_PARAM      = "method"
+	RESET_ACTION              = "reset"              // start the endpoint sequence over
+	REQUESTS_ACTION           = "requests"           // list logged requests of the site
+	CLEAR_REQUESTS_ACTION     = "clear_requests"     // forget logged requests of the site
+	EXPECT_ACTION             = "expect"             // add an expectation
+	VERIFY_ACTION             = "verify"             // check logged requests against expectations
+	CLEAR_EXPECTATIONS_ACTION = "clear_expectations" // forget expectations of the site
+	PROXY_ACTION              = "proxy"              // proxy unknown paths of the site to the upstream
+	RECORD_ACTION             = "record"             // proxy and save upstream responses as endpoints
+	REPLAY_ACTION             = "replay"             // stop proxying and serve only the endpoints
+	DELETE_ACTION             = "delete"             // delete the endpoint
+	CLEAR_ACTION              = "clear"              // delete all endpoints of the site
+	DELETE_SITE_ACTION        = "delete_site"        // delete the site with everything it has
+	EXPORT_ACTION             = "export"             // respond with the site bundle
+	IMPORT_ACTION             = "import"             // save endpoints of the site bundle
+	OPENAPI_ACTION            = "openapi"            // save endpoints made from the OpenAPI spec
+)
+
+const (
+	DELAY_PARAM            = "delay"
+	SEED_PARAM             = "seed"
+	BANDWIDTH_PARAM        = "bandwidth"
+	CHUNK_SIZE_PARAM       = "chunk_size"
+	BODY_DELAY_PARAM       = "body_delay"
+	STALL_DELAY_PARAM      = "stall_delay"
+	STALL_AT_PARAM         = "stall_at"
+	FAULT_PARAM            = "fault"
+	WEIGHT_PARAM           = "weight"
+	VARIANT_PARAM          = "variant"
+	STEP_PARAM             = "step"
+	LOOP_PARAM             = "loop"
+	RATE_LIMIT_PARAM       = "rate_limit"
+	RATE_LIMIT_KEY_PARAM   = "rate_limit_key"
+	RATE_LIMIT_BODY_PARAM  = "rate_limit_body"
+	OUTAGE_PARAM           = "outage"
+	OUTAGE_RESPONSE_PARAM  = "outage_response"
+	MODE_PARAM             = "mode"
+	REQUEST_PATH_PARAM     = "request_path"
+	LIMIT_PARAM            = "limit"
+	TIMES_PARAM            = "times"
+	MIN_TIMES_PARAM        = "min_times"
+	MAX_TIMES_PARAM        = "max_times"
+	ALLOW_UNEXPECTED_PARAM = "allow_unexpected"
+	UPSTREAM_PARAM         = "upstream"
+	ERROR_RATE_PARAM       = "error_rate"
+	ERROR_STATUS_PARAM     = "error_status"
+	REPLACE_PARAM          = "replace"
+	ACTION_PARAM           = "action"
+	STATUS_CODE_PARAM      = "status"
+	METHOD_PARAM           = "method"
+	PATH_REGEXP_PARAM      = "path_regex"
+
+	MATCH_QUERY_PARAM       = "match_query"
+	MATCH_HEADER_PARAM      = "match_header"
+	MATCH_BODY_PARAM        = "match_body"
+	MATCH_BODY_REGEXP_PARAM = "match_body_regex"
+	MATCH_JSON_PARAM        = "match_json"
+
+	HEADER_PARAM          = "header"
+	HEADER_SEPARATOR      = ":"
+	HEADER_REQUEST_PREFIX = "X-Goslow-Header-"
 )
 
 type Server struct {
-	config  *Config
-	storage *Storage
-	hasher  *hashids.HashID // used to generate new site names
+	config    *Config
+	storage   *Storage
+	hasher    *hashids.HashID   // used to generate new site names
+	randoms   *RandomSources    // used to sample delays of endpoints with a seed
+	sequences *Counters         // current steps of endpoint sequences
+	limiter   *RateLimiter      // current windows of endpoints with a rate limit
+	clock     Clock             // used by outage schedules and rate limits
+	hits      *Counters         // requests to endpoints with templated responses
+	transport http.RoundTripper // used to proxy requests, see newUpstreamTransport
 }
 
 func NewServer(config *Config) *Server {
@@ -71,9 +136,15 @@ func NewServer(config *Config) *Server {
 	}
 
 	server := &Server{
-		config:  config,
-		storage: storage,
-		hasher:  newHasher(config.siteSalt, config.minSiteLength),
+		config:    config,
+		storage:   storage,
+		hasher:    newHasher(config.siteSalt, config.minSiteLength),
+		randoms:   NewRandomSources(),
+		sequences: NewCounters(),
+		limiter:   NewRateLimiter(),
+		clock:     SYSTEM_CLOCK,
+		hits:      NewCounters(),
+		transport: newUpstreamTransport(config.allowPrivateUpstreams),
 	}
 
 	if config.createDefaultEndpoints {
@@ -82,6 +153,9 @@ func NewServer(config *Config) *Server {
 	if server.isInSingleSiteMode() {
 		server.ensureEmptySiteExists()
 	}
+	if config.configFile != "" {
+		server.loadConfigFile()
+	}
 	return server
 }
 
@@ -106,6 +180,12 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	case server.isCreateSite(req):
 		err = server.createSite(w, req)
 
+	case server.isApi(req):
+		server.handleApi(w, req)
+
+	case server.isListEndpoints(req):
+		err = server.listEndpoints(w, req)
+
 	case server.isAdmin(req):
 		err = server.handleCreateEndpoint(w, req)
 
@@ -156,6 +236,9 @@ func (server *Server) createSite(w http.ResponseWriter, req *http.Request) error
 	if err != nil {
 		return err
 	}
+	if action := req.URL.Query().Get(ACTION_PARAM); action == IMPORT_ACTION || action == OPENAPI_ACTION {
+		return server.createSiteFromBundle(w, site, req)
+	}
 	endpoint, err := server.createEndpoint(site, req)
 	if err != nil {
 		return err
@@ -169,6 +252,27 @@ func (server *Server) createSite(w http.ResponseWriter, req *http.Request) error
 	return nil
 }
 
+// Server.createSiteFromBundle deletes the new site if the bundle (or the OpenAPI spec) can't be imported.
+func (server *Server) createSiteFromBundle(w http.ResponseWriter, site string, req *http.Request) error {
+	importBundle := server.importBundle
+	if req.URL.Query().Get(ACTION_PARAM) == OPENAPI_ACTION {
+		importBundle = server.importOpenApi
+	}
+	bundle, err := importBundle(site, req)
+	if err != nil {
+		server.storage.DeleteSite(site)
+		return err
+	}
+	if wantsShortResponse(req) {
+		fmt.Fprint(w, server.makeFullDomain(site))
+		return nil
+	}
+	server.showImportedBundle(w, site, bundle)
+	fmt.Fprintln(w)
+	SITE_CREATED_TEMPLATE.Execute(w, server.makeTemplateData(&Endpoint{Site: site}))
+	return nil
+}
+
 func (server *Server) generateUniqueSiteName(maxAttempts int) (string, error) {
 	for i := 0; i < maxAttempts; i++ {
 		site, err := server.makeSiteNameFrom(generateUniqueNumbers())
@@ -202,8 +306,38 @@ func (server *Server) createEndpoint(site string, req *http.Request) (*Endpoint,
 	if err != nil {
 		return nil, err
 	}
-	err = server.storage.SaveEndpoint(endpoint)
-	return endpoint, err
+	err = server.saveEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func (server *Server) saveEndpoint(endpoint *Endpoint) error {
+	err := server.storage.SaveEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	server.forget(endpoint)
+	return nil
+}
+
+func (server *Server) deleteEndpoint(endpoint *Endpoint) (bool, error) {
+	deleted, err := server.storage.DeleteEndpoint(endpoint)
+	if err != nil {
+		return false, err
+	}
+	server.forget(endpoint)
+	return deleted, nil
+}
+
+// Server.forget resets the in-memory state of the endpoint:
+// random source, position in the sequence, rate limit windows, and the number of requests.
+func (server *Server) forget(endpoint *Endpoint) {
+	server.randoms.Reset(endpoint)
+	server.sequences.Reset(endpoint)
+	server.limiter.Reset(endpoint)
+	server.hits.Reset(endpoint)
 }
 
 func (server *Server) makeEndpoint(site string, req *http.Request) (*Endpoint, error) {
@@ -212,7 +346,19 @@ func (server *Server) makeEndpoint(site string, req *http.Request) (*Endpoint, e
 		return nil, err
 	}
 
-	delay, err := server.getEndpointDelay(values)
+	delay, delayDistribution, err := server.getEndpointDelay(values)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := server.getEndpointSeed(values)
+	if err != nil {
+		return nil, err
+	}
+	bytesPerSecond, err := getPositiveIntParam(values, BANDWIDTH_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize, err := getPositiveIntParam(values, CHUNK_SIZE_PARAM)
 	if err != nil {
 		return nil, err
 	}
@@ -220,39 +366,210 @@ func (server *Server) makeEndpoint(site string, req *http.Request) (*Endpoint, e
 	if err != nil {
 		return nil, err
 	}
+	path, pathIsRegexp, err := server.getEndpointPathPattern(req, values)
+	if err != nil {
+		return nil, err
+	}
+	predicates, err := server.getEndpointPredicates(values)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := server.getEndpointHeaders(req, values)
+	if err != nil {
+		return nil, err
+	}
+	bodyDelay, err := getDelayParam(values, BODY_DELAY_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	stallDelay, err := getDelayParam(values, STALL_DELAY_PARAM)
+	if err != nil {
+		return nil, err
+	}
 	response, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		return nil, err
 	}
+	stallOffset, err := getStallOffset(values, response)
+	if err != nil {
+		return nil, err
+	}
+	fault, err := server.getEndpointFault(values)
+	if err != nil {
+		return nil, err
+	}
+	weight, err := server.getEndpointWeight(values)
+	if err != nil {
+		return nil, err
+	}
+	variants, err := server.getEndpointVariants(values, VARIANT_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	sequence, err := server.getEndpointVariants(values, STEP_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	loop, err := getBoolParam(values, LOOP_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	rateLimit, err := server.getEndpointRateLimit(values)
+	if err != nil {
+		return nil, err
+	}
+	outage, err := server.getEndpointOutage(values)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := server.getEndpointMode(values)
+	if err != nil {
+		return nil, err
+	}
 	endpoint := &Endpoint{
-		Site:       site,
-		Path:       server.getEndpointPath(req),
-		Method:     server.getEndpointMethod(values),
-		Headers:    EMPTY_HEADERS,
-		Delay:      delay,
-		StatusCode: statusCode,
-		Response:   response,
+		Site:              site,
+		Path:              path,
+		PathIsRegexp:      pathIsRegexp,
+		Method:            server.getEndpointMethod(values),
+		Predicates:        predicates,
+		Headers:           headers,
+		Delay:             delay,
+		DelayDistribution: delayDistribution,
+		Seed:              seed,
+		StatusCode:        statusCode,
+		Response:          response,
+		BytesPerSecond:    bytesPerSecond,
+		ChunkSize:         chunkSize,
+		BodyDelay:         bodyDelay,
+		StallDelay:        stallDelay,
+		StallOffset:       stallOffset,
+		Fault:             fault,
+		Weight:            weight,
+		Variants:          variants,
+		Sequence:          sequence,
+		Loop:              loop,
+		RateLimit:         rateLimit,
+		Outage:            outage,
+		Mode:              mode,
+	}
+	if mode == TEMPLATE_MODE {
+		err = endpoint.checkResponseTemplates()
+		if err != nil {
+			return nil, err
+		}
 	}
 	return endpoint, nil
 }
 
-func (server *Server) getEndpointDelay(values url.Values) (time.Duration, error) {
-	_, hasDelay := values[DELAY_PARAM]
-	if !hasDelay {
-		return DEFAULT_DELAY, nil
+// Server.makeEndpointKey makes an endpoint with only the params identifying it: path, method, and predicates.
+// Unlike Server.makeEndpoint it doesn't read the request body.
+func (server *Server) makeEndpointKey(site string, req *http.Request) (*Endpoint, error) {
+	values, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	path, pathIsRegexp, err := server.getEndpointPathPattern(req, values)
+	if err != nil {
+		return nil, err
+	}
+	predicates, err := server.getEndpointPredicates(values)
+	if err != nil {
+		return nil, err
 	}
+	return &Endpoint{Site: site, Path: path, PathIsRegexp: pathIsRegexp, Method: server.getEndpointMethod(values),
+		Predicates: predicates}, nil
+}
 
-	rawDelay := values.Get(DELAY_PARAM)
-	delayInSeconds, err := strconv.ParseFloat(rawDelay, 64)
+// If the path_regex param is given, then it's used instead of the request path.
+func (server *Server) getEndpointPathPattern(req *http.Request, values url.Values) (string, bool, error) {
+	_, hasPathRegexp := values[PATH_REGEXP_PARAM]
+	if !hasPathRegexp {
+		path := server.getEndpointPath(req)
+		return path, false, checkGlob(path)
+	}
+	pathRegexp := values.Get(PATH_REGEXP_PARAM)
+	_, err := compileRegexp(pathRegexp)
 	if err != nil {
-		return time.Duration(0), InvalidDelayError(rawDelay)
+		return "", false, InvalidPathRegexpError(pathRegexp, err)
 	}
+	return pathRegexp, true, nil
+}
 
-	delay := secondsToDuration(delayInSeconds)
-	if delay > MAX_DELAY {
-		return time.Duration(0), DelayIsTooBigError(delay)
+func (server *Server) getEndpointPredicates(values url.Values) ([]*Predicate, error) {
+	predicates := make([]*Predicate, 0)
+	sources := map[string]string{
+		MATCH_QUERY_PARAM:  QUERY_PREDICATE,
+		MATCH_HEADER_PARAM: HEADER_PREDICATE,
+	}
+	for param, source := range sources {
+		for _, rawPredicate := range values[param] {
+			predicate, err := parsePredicate(source, rawPredicate)
+			if err != nil {
+				return nil, err
+			}
+			predicates = append(predicates, predicate)
+		}
+	}
+	bodyPredicateKinds := map[string]string{
+		MATCH_BODY_PARAM:        CONTAINS_PREDICATE,
+		MATCH_BODY_REGEXP_PARAM: REGEXP_PREDICATE,
+		MATCH_JSON_PARAM:        JSON_EQUALS_PREDICATE,
+	}
+	for param, kind := range bodyPredicateKinds {
+		for _, rawPredicate := range values[param] {
+			predicate, err := parseBodyPredicate(kind, rawPredicate)
+			if err != nil {
+				return nil, err
+			}
+			predicates = append(predicates, predicate)
+		}
+	}
+	sortPredicates(predicates)
+	return predicates, nil
+}
+
+// Response headers are given either as header=NAME:VALUE params
+// or as X-Goslow-Header-NAME: VALUE request headers. Both can be repeated.
+func (server *Server) getEndpointHeaders(req *http.Request, values url.Values) (http.Header, error) {
+	headers := make(http.Header)
+	for _, rawHeader := range values[HEADER_PARAM] {
+		parts := strings.SplitN(rawHeader, HEADER_SEPARATOR, 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, InvalidHeaderError(rawHeader)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	for name, headerValues := range req.Header {
+		if !strings.HasPrefix(name, HEADER_REQUEST_PREFIX) || name == HEADER_REQUEST_PREFIX {
+			continue
+		}
+		for _, value := range headerValues {
+			headers.Add(strings.TrimPrefix(name, HEADER_REQUEST_PREFIX), value)
+		}
+	}
+	return headers, nil
+}
+
+// See parseDelay for the supported syntax.
+func (server *Server) getEndpointDelay(values url.Values) (time.Duration, *DelayDistribution, error) {
+	_, hasDelay := values[DELAY_PARAM]
+	if !hasDelay {
+		return DEFAULT_DELAY, nil, nil
+	}
+	return parseDelay(values.Get(DELAY_PARAM))
+}
+
+func (server *Server) getEndpointSeed(values url.Values) (*int64, error) {
+	_, hasSeed := values[SEED_PARAM]
+	if !hasSeed {
+		return nil, nil
+	}
+	rawSeed := values.Get(SEED_PARAM)
+	seed, err := strconv.ParseInt(rawSeed, 10, 64)
+	if err != nil {
+		return nil, InvalidSeedError(rawSeed)
 	}
-	return delay, nil
+	return &seed, nil
 }
 
 // Convert with millisecond precision
@@ -261,6 +578,149 @@ func secondsToDuration(seconds float64) time.Duration {
 	return time.Duration(milliseconds) * time.Millisecond
 }
 
+// getDelayParam parses a fixed delay (2.5 or 2500ms), returns 0 if the param is missing.
+func getDelayParam(values url.Values, param string) (time.Duration, error) {
+	_, hasParam := values[param]
+	if !hasParam {
+		return 0, nil
+	}
+	return parseDelayValue(values.Get(param))
+}
+
+// getStallOffset defaults to the middle of the response.
+func getStallOffset(values url.Values, response []byte) (int, error) {
+	_, hasStallAt := values[STALL_AT_PARAM]
+	if !hasStallAt {
+		return len(response) / 2, nil
+	}
+	rawStallAt := values.Get(STALL_AT_PARAM)
+	stallAt, err := strconv.Atoi(rawStallAt)
+	if err != nil || stallAt < 0 || stallAt > len(response) {
+		return 0, InvalidStallOffsetError(rawStallAt, len(response))
+	}
+	return stallAt, nil
+}
+
+func (server *Server) getEndpointFault(values url.Values) (string, error) {
+	fault := values.Get(FAULT_PARAM)
+	if fault != NO_FAULT && !isFault(fault) {
+		return NO_FAULT, UnknownFaultError(fault)
+	}
+	return fault, nil
+}
+
+func (server *Server) getEndpointWeight(values url.Values) (int, error) {
+	_, hasWeight := values[WEIGHT_PARAM]
+	if !hasWeight {
+		return DEFAULT_WEIGHT, nil
+	}
+	rawWeight := values.Get(WEIGHT_PARAM)
+	weight, err := strconv.Atoi(rawWeight)
+	if err != nil || weight < 0 {
+		return 0, InvalidWeightError(rawWeight)
+	}
+	return weight, nil
+}
+
+// See parseVariant for the supported syntax.
+func (server *Server) getEndpointVariants(values url.Values, param string) ([]*Variant, error) {
+	variants := make([]*Variant, 0)
+	for _, rawVariant := range values[param] {
+		variant, err := parseVariant(rawVariant)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
+
+// See parseRateLimit for the supported syntax.
+func (server *Server) getEndpointRateLimit(values url.Values) (*RateLimit, error) {
+	_, hasRateLimit := values[RATE_LIMIT_PARAM]
+	if !hasRateLimit {
+		return nil, nil
+	}
+	return parseRateLimit(values.Get(RATE_LIMIT_PARAM), values.Get(RATE_LIMIT_KEY_PARAM),
+		[]byte(values.Get(RATE_LIMIT_BODY_PARAM)))
+}
+
+// Outage windows are given as repeated outage params, see parseOutageWindow for the supported syntax.
+// Outage response has the same syntax as variants and defaults to 503.
+func (server *Server) getEndpointOutage(values url.Values) (*OutageSchedule, error) {
+	_, hasOutage := values[OUTAGE_PARAM]
+	if !hasOutage {
+		return nil, nil
+	}
+	schedule := &OutageSchedule{Response: &Variant{StatusCode: http.StatusServiceUnavailable}}
+	for _, rawWindow := range values[OUTAGE_PARAM] {
+		window, err := parseOutageWindow(rawWindow)
+		if err != nil {
+			return nil, err
+		}
+		schedule.Windows = append(schedule.Windows, window)
+	}
+	_, hasResponse := values[OUTAGE_RESPONSE_PARAM]
+	if hasResponse {
+		response, err := parseVariant(values.Get(OUTAGE_RESPONSE_PARAM))
+		if err != nil {
+			return nil, err
+		}
+		schedule.Response = response
+	}
+	return schedule, nil
+}
+
+func (server *Server) getEndpointMode(values url.Values) (string, error) {
+	mode := values.Get(MODE_PARAM)
+	if mode != STATIC_MODE && !isMode(mode) {
+		return STATIC_MODE, UnknownModeError(mode)
+	}
+	return mode, nil
+}
+
+// getBoolParam returns false if the param is missing.
+func getBoolParam(values url.Values, param string) (bool, error) {
+	_, hasParam := values[param]
+	if !hasParam {
+		return false, nil
+	}
+	rawValue := values.Get(param)
+	value, err := strconv.ParseBool(rawValue)
+	if err != nil {
+		return false, InvalidBoolError(param, rawValue)
+	}
+	return value, nil
+}
+
+// getNonNegativeIntParam returns defaultValue if the param is missing.
+func getNonNegativeIntParam(values url.Values, param string, defaultValue int) (int, error) {
+	_, hasParam := values[param]
+	if !hasParam {
+		return defaultValue, nil
+	}
+	rawValue := values.Get(param)
+	value, err := strconv.Atoi(rawValue)
+	if err != nil || value < 0 {
+		return 0, NegativeIntError(param, rawValue)
+	}
+	return value, nil
+}
+
+// getPositiveIntParam returns 0 if the param is missing.
+func getPositiveIntParam(values url.Values, param string) (int, error) {
+	_, hasParam := values[param]
+	if !hasParam {
+		return 0, nil
+	}
+	rawValue := values.Get(param)
+	value, err := strconv.Atoi(rawValue)
+	if err != nil || value <= 0 {
+		return 0, NotPositiveIntError(param, rawValue)
+	}
+	return value, nil
+}
+
 func (server *Server) getEndpointStatusCode(values url.Values) (int, error) {
 	_, hasStatusCode := values[STATUS_CODE_PARAM]
 	if !hasStatusCode {
@@ -344,7 +804,23 @@ func (server *Server) makeTemplateData(endpoint *Endpoint) *TemplateData {
 		Site:              endpoint.Site,
 		Path:              endpoint.Path,
 		Method:            endpoint.Method,
+		StatusCode:        endpoint.StatusCode,
 		Delay:             endpoint.Delay,
+		DelayDistribution: endpoint.DelayDistribution,
+		Predicates:        endpoint.Predicates,
+		Headers:           endpoint.Headers,
+		BytesPerSecond:    endpoint.BytesPerSecond,
+		BodyDelay:         endpoint.BodyDelay,
+		StallDelay:        endpoint.StallDelay,
+		StallOffset:       endpoint.StallOffset,
+		Fault:             endpoint.Fault,
+		Weight:            endpoint.Weight,
+		Variants:          endpoint.Variants,
+		Sequence:          endpoint.Sequence,
+		Loop:              endpoint.Loop,
+		RateLimit:         endpoint.RateLimit,
+		Outage:            endpoint.Outage,
+		Mode:              endpoint.Mode,
 		TruncatedResponse: truncate(string(endpoint.Response), 80),
 		CreateDomain:      server.makeFullDomain(CREATE_SUBDOMAIN),
 		Domain:            server.makeFullDomain(endpoint.Site),
@@ -389,17 +865,121 @@ func (server *Server) respondFromEndpoint(w http.ResponseWriter, req *http.Reque
 		return err
 	}
 	if found {
-		respondWith(endpoint, w)
+		random := server.randoms.For(endpoint)
+		endpoint = server.chooseResponse(endpoint, random, req)
+		endpoint, err = server.renderResponse(endpoint, random, req)
+		if err != nil {
+			return err
+		}
+		delay := endpoint.SampleDelay(random)
+		server.logRequest(endpoint.Site, req, endpoint, delay)
+		respondWith(endpoint, delay, w)
 	} else {
+		return server.handleUnmatchedRequest(w, req)
+	}
+	return nil
+}
+
+// Server.handleUnmatchedRequest proxies the request if the site has an upstream and the proxy is allowed.
+func (server *Server) handleUnmatchedRequest(w http.ResponseWriter, req *http.Request) error {
+	site, found, err := server.storage.GetSite(server.getSite(req))
+	if err != nil {
+		return err
+	}
+	if !found || !site.IsProxy() || !server.config.allowProxy {
 		return server.handleUnknownEndpoint(w, req)
 	}
+	server.logRequest(site.Name, req, nil, site.Delay)
+	recorded, err := proxyTo(site, server.transport, GLOBAL_RANDOM, w, req)
+	if err != nil || recorded == nil {
+		return err
+	}
+	err = server.saveEndpoint(recorded)
+	if err != nil {
+		log.Printf("error: can't record endpoint %s: %s", recorded, err)
+	}
 	return nil
 }
 
-func (server *Server) isAdmin(req *http.Request) bool {
-	if req.Method != "POST" {
-		return false
+// Server.logRequest remembers the request for the admin API, endpoint is nil if there's no matching endpoint.
+// Errors are logged and don't affect the response.
+func (server *Server) logRequest(site string, req *http.Request, endpoint *Endpoint, delay time.Duration) {
+	if server.config.maxLoggedRequests <= 0 || !canChange(site) {
+		return
+	}
+	request, err := newLoggedRequest(site, req, endpoint, delay, server.clock.Now())
+	if err == nil {
+		err = server.storage.LogRequest(request, server.config.maxLoggedRequests)
+	}
+	if err != nil {
+		log.Printf("error: can't log request: %s", err)
+	}
+}
+
+// Server.chooseResponse returns the outage response during the scheduled outages of the endpoint
+// and rejects requests over its rate limit. Allowed requests get the current step of the endpoint sequence.
+// If the sequence has come to the endpoint itself, then a random variant is chosen.
+func (server *Server) chooseResponse(endpoint *Endpoint, random Random, req *http.Request) *Endpoint {
+	now := server.clock.Now()
+	if endpoint.Outage != nil && endpoint.Outage.IsActive(now) {
+		return endpoint.withVariant(endpoint.Outage.Response)
+	}
+	limit := endpoint.RateLimit
+	if limit == nil {
+		return server.chooseAllowedResponse(endpoint, random)
 	}
+	status := server.limiter.Take(endpoint, req, now)
+	if !status.Allowed {
+		return endpoint.rejectedByRateLimit().withRateLimitHeaders(limit, status, now)
+	}
+	return server.chooseAllowedResponse(endpoint, random).withRateLimitHeaders(limit, status, now)
+}
+
+// Server.renderResponse returns a copy of the endpoint with the response for this request:
+// templated responses are executed, echo responses describe the request,
+// and static responses have the regexp captures expanded.
+func (server *Server) renderResponse(endpoint *Endpoint, random Random, req *http.Request) (*Endpoint, error) {
+	rendered := *endpoint
+	var err error
+	switch endpoint.Mode {
+	case TEMPLATE_MODE:
+		var data *RequestData
+		data, err = makeRequestData(endpoint, req)
+		if err != nil {
+			return nil, err
+		}
+		data.Count = server.hits.Next(endpoint) + 1
+		data.Now = server.clock.Now()
+		rendered.Response, err = endpoint.RenderResponse(data, random)
+	case ECHO_MODE:
+		rendered.Response, err = echoRequest(req)
+		if endpoint.Headers.Get("Content-Type") == "" {
+			rendered.Headers = make(http.Header)
+			addHeaders(endpoint.Headers, rendered.Headers)
+			rendered.Headers.Set("Content-Type", "application/json")
+		}
+	default:
+		rendered.Response = endpoint.ExpandResponse(req)
+	}
+	return &rendered, err
+}
+
+func (server *Server) chooseAllowedResponse(endpoint *Endpoint, random Random) *Endpoint {
+	if len(endpoint.Sequence) > 0 {
+		step := endpoint.ChooseStep(server.sequences.Next(endpoint))
+		if step != endpoint {
+			return step
+		}
+	}
+	return endpoint.ChooseVariant(random)
+}
+
+func (server *Server) isAdmin(req *http.Request) bool {
+	return req.Method == "POST" && server.isAdminDomain(req)
+}
+
+// Server.isAdminDomain checks for the admin domain or for the admin path prefix in the single site mode.
+func (server *Server) isAdminDomain(req *http.Request) bool {
 	if server.isInSingleSiteMode() {
 		return server.isAdminPath(req.URL.Path)
 	}
@@ -419,6 +999,47 @@ func (server *Server) isAdminPath(path string) bool {
 	return suffix == "" || suffix[0] == '?' || suffix[0] == '/'
 }
 
+// Server.isListEndpoints checks for GET of the admin domain root (of the admin path prefix in the single site mode),
+// other admin paths aren't reserved.
+func (server *Server) isListEndpoints(req *http.Request) bool {
+	return req.Method == "GET" && server.isAdminDomain(req) && server.getEndpointPath(req) == "/"
+}
+
+// Server.listEndpoints shows all endpoints of the site as text,
+// or as JSON array of EndpointResource (same as the API) if the client accepts JSON.
+func (server *Server) listEndpoints(w http.ResponseWriter, req *http.Request) error {
+	site := server.getSite(req)
+	siteExists, err := server.storage.SiteExists(site)
+	if err != nil {
+		return err
+	}
+	if !siteExists {
+		return UnknownSiteError(site)
+	}
+	endpoints, err := server.storage.GetEndpoints(site)
+	if err != nil {
+		return err
+	}
+	if acceptsJson(req) {
+		return writeJson(w, http.StatusOK, newEndpointResources(endpoints))
+	}
+	BANNER_TEMPLATE.Execute(w, nil)
+	siteData := server.makeTemplateData(&Endpoint{Site: site})
+	if len(endpoints) == 0 {
+		NO_ENDPOINTS_TEMPLATE.Execute(w, siteData)
+		return nil
+	}
+	SITE_ENDPOINTS_TEMPLATE.Execute(w, siteData)
+	for _, endpoint := range endpoints {
+		ENDPOINT_SUMMARY_TEMPLATE.Execute(w, server.makeTemplateData(endpoint))
+	}
+	return nil
+}
+
+func acceptsJson(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
 // TODO: rename
 func (server *Server) handleCreateEndpoint(w http.ResponseWriter, req *http.Request) error {
 	site := server.getSite(req)
@@ -433,21 +1054,353 @@ func (server *Server) handleCreateEndpoint(w http.ResponseWriter, req *http.Requ
 		// TODO: show a long help text here (like in handleUnknownEndpoint)
 		return UnknownSiteError(site)
 	}
-	endpoint, err := server.createEndpoint(site, req)
+	switch action := req.URL.Query().Get(ACTION_PARAM); action {
+	case "":
+		endpoint, err := server.createEndpoint(site, req)
+		if err != nil {
+			return err
+		}
+		BANNER_TEMPLATE.Execute(w, nil)
+		ENDPOINT_ADDED_TEMPLATE.Execute(w, server.makeTemplateData(endpoint))
+	case RESET_ACTION:
+		return server.resetSequence(w, site, req)
+	case REQUESTS_ACTION:
+		return server.listRequests(w, site, req)
+	case CLEAR_REQUESTS_ACTION:
+		err := server.storage.ClearRequests(site)
+		if err != nil {
+			return err
+		}
+		BANNER_TEMPLATE.Execute(w, nil)
+		REQUESTS_CLEARED_TEMPLATE.Execute(w, server.makeTemplateData(&Endpoint{Site: site}))
+	case EXPECT_ACTION:
+		expectation, err := server.makeExpectation(site, req)
+		if err != nil {
+			return err
+		}
+		err = server.storage.SaveExpectation(expectation)
+		if err != nil {
+			return err
+		}
+		BANNER_TEMPLATE.Execute(w, nil)
+		EXPECTATION_ADDED_TEMPLATE.Execute(w, expectation)
+	case VERIFY_ACTION:
+		return server.verify(w, site, req)
+	case PROXY_ACTION, RECORD_ACTION:
+		return server.configureProxy(w, site, req, action == RECORD_ACTION)
+	case REPLAY_ACTION:
+		return server.replay(w, site, req)
+	case DELETE_ACTION:
+		return server.deleteEndpointByParams(w, site, req)
+	case CLEAR_ACTION:
+		err := server.clearEndpoints(site)
+		if err != nil {
+			return err
+		}
+		BANNER_TEMPLATE.Execute(w, nil)
+		ENDPOINTS_CLEARED_TEMPLATE.Execute(w, server.makeTemplateData(&Endpoint{Site: site}))
+	case DELETE_SITE_ACTION:
+		return server.deleteSite(w, site)
+	case EXPORT_ACTION:
+		return server.exportSite(w, site)
+	case IMPORT_ACTION:
+		bundle, err := server.importBundle(site, req)
+		if err != nil {
+			return err
+		}
+		server.showImportedBundle(w, site, bundle)
+	case OPENAPI_ACTION:
+		bundle, err := server.importOpenApi(site, req)
+		if err != nil {
+			return err
+		}
+		server.showImportedBundle(w, site, bundle)
+	case CLEAR_EXPECTATIONS_ACTION:
+		err := server.storage.ClearExpectations(site)
+		if err != nil {
+			return err
+		}
+		BANNER_TEMPLATE.Execute(w, nil)
+		EXPECTATIONS_CLEARED_TEMPLATE.Execute(w, server.makeTemplateData(&Endpoint{Site: site}))
+	default:
+		return UnknownActionError(action)
+	}
+	return nil
+}
+
+// Server.resetSequence finds the endpoint by the same params that were used to create it.
+func (server *Server) resetSequence(w http.ResponseWriter, site string, req *http.Request) error {
+	key, err := server.makeEndpointKey(site, req)
+	if err != nil {
+		return err
+	}
+	endpoint, found, err := server.storage.GetEndpoint(key)
 	if err != nil {
 		return err
 	}
+	if !found {
+		return UnknownEndpointError(key.String())
+	}
+	server.sequences.Reset(endpoint)
 	BANNER_TEMPLATE.Execute(w, nil)
-	ENDPOINT_ADDED_TEMPLATE.Execute(w, server.makeTemplateData(endpoint))
+	SEQUENCE_RESET_TEMPLATE.Execute(w, server.makeTemplateData(endpoint))
 	return nil
 }
 
+// Server.deleteEndpointByParams finds the endpoint by the same params that were used to create it,
+// only the params making the endpoint key are used, see makeEndpointKey.
+func (server *Server) deleteEndpointByParams(w http.ResponseWriter, site string, req *http.Request) error {
+	endpoint, err := server.makeEndpointKey(site, req)
+	if err != nil {
+		return err
+	}
+	deleted, err := server.deleteEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return UnknownEndpointError(endpoint.String())
+	}
+	BANNER_TEMPLATE.Execute(w, nil)
+	ENDPOINT_DELETED_TEMPLATE.Execute(w, server.makeTemplateData(endpoint))
+	return nil
+}
+
+func (server *Server) clearEndpoints(site string) error {
+	endpoints, err := server.storage.GetEndpoints(site)
+	if err != nil {
+		return err
+	}
+	err = server.storage.ClearEndpoints(site)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		server.forget(endpoint)
+	}
+	return nil
+}
+
+// Server.deleteSite deletes the site with its endpoints, settings, logged requests, and expectations.
+// The only site of the single site mode can't be deleted, but it can be cleared.
+func (server *Server) deleteSite(w http.ResponseWriter, site string) error {
+	if server.isInSingleSiteMode() {
+		return CantDeleteSingleSiteError()
+	}
+	endpoints, err := server.storage.GetEndpoints(site)
+	if err != nil {
+		return err
+	}
+	err = server.storage.DeleteSite(site)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		server.forget(endpoint)
+	}
+	BANNER_TEMPLATE.Execute(w, nil)
+	SITE_DELETED_TEMPLATE.Execute(w, server.makeTemplateData(&Endpoint{Site: site}))
+	return nil
+}
+
+// Server.listRequests responds with JSON array of the logged requests, oldest first.
+// Requests can be filtered by method, request_path (glob pattern), and limit (only the latest requests).
+func (server *Server) listRequests(w http.ResponseWriter, site string, req *http.Request) error {
+	values := req.URL.Query()
+	limit, err := getPositiveIntParam(values, LIMIT_PARAM)
+	if err != nil {
+		return err
+	}
+	filter := &RequestFilter{Method: values.Get(METHOD_PARAM), Path: values.Get(REQUEST_PATH_PARAM), Limit: limit}
+	requests, err := server.storage.GetRequests(site)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(filter.Apply(requests))
+}
+
+// Server.configureProxy sets the upstream of the site with delay, bandwidth, error_rate and error_status params.
+func (server *Server) configureProxy(w http.ResponseWriter, name string, req *http.Request, record bool) error {
+	if !server.config.allowProxy {
+		return ProxyIsOffError()
+	}
+	values := req.URL.Query()
+	upstream, err := parseUpstream(values.Get(UPSTREAM_PARAM), server.config.allowPrivateUpstreams)
+	if err != nil {
+		return err
+	}
+	delay, err := getDelayParam(values, DELAY_PARAM)
+	if err != nil {
+		return err
+	}
+	bytesPerSecond, err := getPositiveIntParam(values, BANDWIDTH_PARAM)
+	if err != nil {
+		return err
+	}
+	errorRate, err := getErrorRate(values)
+	if err != nil {
+		return err
+	}
+	errorStatusCode := DEFAULT_PROXY_ERROR_STATUS_CODE
+	_, hasErrorStatus := values[ERROR_STATUS_PARAM]
+	if hasErrorStatus {
+		errorStatusCode, err = strconv.Atoi(values.Get(ERROR_STATUS_PARAM))
+		if err != nil || errorStatusCode < 100 || errorStatusCode > 999 {
+			return InvalidStatusCodeError(values.Get(ERROR_STATUS_PARAM))
+		}
+	}
+	site := &Site{Name: name, Upstream: upstream, Delay: delay, BytesPerSecond: bytesPerSecond,
+		ErrorRate: errorRate, ErrorStatusCode: errorStatusCode, Record: record && upstream != ""}
+	err = server.storage.SaveSite(site)
+	if err != nil {
+		return err
+	}
+	data := server.makeTemplateData(&Endpoint{Site: name, Delay: delay, BytesPerSecond: bytesPerSecond})
+	data.Upstream = upstream
+	data.ErrorRate = errorRate
+	data.ErrorStatusCode = errorStatusCode
+	data.Record = site.Record
+	BANNER_TEMPLATE.Execute(w, nil)
+	PROXY_CONFIGURED_TEMPLATE.Execute(w, data)
+	return nil
+}
+
+// Server.replay turns off the proxy of the site, so only the endpoints (e.g recorded ones) respond.
+// If the delay param is given, then it's set for all endpoints of the site.
+func (server *Server) replay(w http.ResponseWriter, name string, req *http.Request) error {
+	values := req.URL.Query()
+	_, hasDelay := values[DELAY_PARAM]
+	delay, err := getDelayParam(values, DELAY_PARAM)
+	if err != nil {
+		return err
+	}
+	err = server.storage.SaveSite(&Site{Name: name})
+	if err != nil {
+		return err
+	}
+	if hasDelay {
+		err = server.storage.SetEndpointsDelay(name, delay)
+		if err != nil {
+			return err
+		}
+	}
+	BANNER_TEMPLATE.Execute(w, nil)
+	REPLAY_TEMPLATE.Execute(w, server.makeTemplateData(&Endpoint{Site: name, Delay: delay}))
+	return nil
+}
+
+func getErrorRate(values url.Values) (float64, error) {
+	_, hasErrorRate := values[ERROR_RATE_PARAM]
+	if !hasErrorRate {
+		return 0, nil
+	}
+	rawErrorRate := values.Get(ERROR_RATE_PARAM)
+	errorRate, err := strconv.ParseFloat(rawErrorRate, 64)
+	if err != nil || errorRate < 0 || errorRate > 1 {
+		return 0, InvalidErrorRateError(rawErrorRate)
+	}
+	return errorRate, nil
+}
+
+// Expectation is made from the same params as an endpoint (path, method, and match_* params)
+// plus the expected number of calls.
+func (server *Server) makeExpectation(site string, req *http.Request) (*Expectation, error) {
+	values, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	path, pathIsRegexp, err := server.getEndpointPathPattern(req, values)
+	if err != nil {
+		return nil, err
+	}
+	predicates, err := server.getEndpointPredicates(values)
+	if err != nil {
+		return nil, err
+	}
+	minTimes, maxTimes, err := server.getExpectedTimes(values)
+	if err != nil {
+		return nil, err
+	}
+	expectation := &Expectation{
+		Site:         site,
+		Path:         path,
+		PathIsRegexp: pathIsRegexp,
+		Method:       server.getEndpointMethod(values),
+		Predicates:   predicates,
+		MinTimes:     minTimes,
+		MaxTimes:     maxTimes,
+	}
+	return expectation, nil
+}
+
+// times=N means exactly N times, otherwise min_times and max_times are the bounds.
+// Default is at least once, or any number of times up to max_times if it's given.
+func (server *Server) getExpectedTimes(values url.Values) (int, int, error) {
+	_, hasTimes := values[TIMES_PARAM]
+	if hasTimes {
+		times, err := getNonNegativeIntParam(values, TIMES_PARAM, 0)
+		return times, times, err
+	}
+	_, hasMaxTimes := values[MAX_TIMES_PARAM]
+	defaultMinTimes := 1
+	if hasMaxTimes {
+		defaultMinTimes = 0
+	}
+	minTimes, err := getNonNegativeIntParam(values, MIN_TIMES_PARAM, defaultMinTimes)
+	if err != nil {
+		return 0, 0, err
+	}
+	maxTimes, err := getNonNegativeIntParam(values, MAX_TIMES_PARAM, UNLIMITED_TIMES)
+	if err != nil {
+		return 0, 0, err
+	}
+	if maxTimes != UNLIMITED_TIMES && maxTimes < minTimes {
+		return 0, 0, InvalidTimesError(minTimes, maxTimes)
+	}
+	return minTimes, maxTimes, nil
+}
+
+// Server.verify responds with JSON Verification, status code is 417 if the verification fails or is inconclusive.
+// Add allow_unexpected=true to ignore requests that don't match any expectation.
+func (server *Server) verify(w http.ResponseWriter, site string, req *http.Request) error {
+	if server.config.maxLoggedRequests <= 0 {
+		return RequestLogIsOffError()
+	}
+	allowUnexpected, err := getBoolParam(req.URL.Query(), ALLOW_UNEXPECTED_PARAM)
+	if err != nil {
+		return err
+	}
+	expectations, err := server.storage.GetExpectations(site)
+	if err != nil {
+		return err
+	}
+	requests, err := server.storage.GetRequests(site)
+	if err != nil {
+		return err
+	}
+	lastTrimmedId, err := server.storage.GetLastTrimmedRequestId(site)
+	if err != nil {
+		return err
+	}
+	verification := verify(expectations, requests, allowUnexpected, lastTrimmedId)
+	w.Header().Set("Content-Type", "application/json")
+	if !verification.Passed {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(verification)
+}
+
 func (server *Server) getSite(req *http.Request) string {
 	if server.isInSingleSiteMode() {
 		return EMPTY_SITE
 	}
 	subdomain := getSubdomain(req.Host)
-	if server.isAdmin(req) {
+	if server.isAdminDomain(req) {
 		return strings.TrimPrefix(subdomain, ADMIN_SUBDOMAIN_PREFIX)
 	}
 	return subdomain
@@ -477,19 +1430,6 @@ func ensureHasPrefix(s, prefix string) string {
 	return s
 }
 
-func respondWith(endpoint *Endpoint, w http.ResponseWriter) {
-	time.Sleep(endpoint.Delay)
-	addHeaders(endpoint.Headers, w.Header())
-	w.WriteHeader(endpoint.StatusCode)
-	w.Write(endpoint.Response)
-}
-
-func addHeaders(headers map[string]string, responseHeader http.Header) {
-	for header, value := range headers {
-		responseHeader.Add(header, value)
-	}
-}
-
 func (server *Server) handleUnknownEndpoint(w http.ResponseWriter, req *http.Request) error {
 	w.WriteHeader(http.StatusNotFound)
 
@@ -498,6 +1438,9 @@ func (server *Server) handleUnknownEndpoint(w http.ResponseWriter, req *http.Req
 	if err != nil {
 		return err
 	}
+	if siteExists {
+		server.logRequest(site, req, nil, 0)
+	}
 
 	endpoint := &Endpoint{Site: site, Path: server.getEndpointPath(req)}
 	templateData := server.makeTemplateData(endpoint)
@@ -566,10 +1509,10 @@ func (server *Server) createDefaultSite(i int) {
 	}
 }
 
-func (server *Server) headersFor(site int) map[string]string {
+func (server *Server) headersFor(site int) http.Header {
 	if isRedirect(site) {
 		zeroDelayURL := fmt.Sprintf("//%s", server.makeFullDomain(ZERO_DELAY_SITE))
-		return map[string]string{"Location": zeroDelayURL}
+		return http.Header{"Location": {zeroDelayURL}}
 	}
 	return EMPTY_HEADERS
 }
@@ -606,6 +1549,17 @@ func (server *Server) ensureEmptySiteExists() {
 	}
 }
 
+func (server *Server) loadConfigFile() {
+	loader := NewConfigLoader(server, server.config.configFile)
+	err := loader.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if server.config.watchConfigFile {
+		go loader.Watch(CONFIG_FILE_POLL_INTERVAL)
+	}
+}
+
 // Server.ListenAndServe listens on the address specified by the config.
 func (server *Server) ListenAndServe() error {
 	log.Printf("listening on %s", server.config.listenOn)
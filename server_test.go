@@ -4,6 +4,8 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,18 +13,23 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 )
 
 const (
-	ANY_DB_DRIVER    = ""
-	MULTI_SITE_MODE  = ""
-	TEST_DEPLOYED_ON = "localhost:9999"
-	TEST_POSTGRES_DB = "goslow_test"
+	ANY_DB_DRIVER            = ""
+	MULTI_SITE_MODE          = ""
+	TEST_DEPLOYED_ON         = "localhost:9999"
+	TEST_MAX_LOGGED_REQUESTS = 1000
+	TEST_POSTGRES_DB         = "goslow_test"
 )
 
 var DATA_SOURCE = map[string]string{
@@ -155,17 +162,24 @@ func (server *TestServer) getAdminPathPrefix() string {
 }
 
 func (server *TestServer) createEndpoint(endpoint *Endpoint) *http.Response {
+	return do(server.makeCreateEndpointRequest(endpoint))
+}
+
+func (server *TestServer) makeCreateEndpointRequest(endpoint *Endpoint) *http.Request {
 	site := "admin-" + endpoint.Site
 	path := endpoint.Path
+	if endpoint.PathIsRegexp {
+		path = "/" // path_regex param is used instead
+	}
 	if server.isInSingleSiteMode() {
 		site = EMPTY_SITE
-		path = join(server.getAdminPathPrefix(), endpoint.Path)
+		path = join(server.getAdminPathPrefix(), path)
 	}
 
 	req := createPOST(server.getURL(), path, makeFullDomain(site),
 		endpoint.Response)
 	req.URL.RawQuery = getQueryString(endpoint)
-	return do(req)
+	return req
 }
 
 func TestChangeBuiltinSites(t *testing.T) {
@@ -314,147 +328,2071 @@ func TestEndpointPathsClash(t *testing.T) {
 	})
 }
 
-func TestEndpointDelay(t *testing.T) {
+func TestEndpointGlobPaths(t *testing.T) {
 	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
 		server.withNewSite(func(site string) {
 
-			delayEndpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Delay: time.Duration(100) * time.Millisecond, Response: []byte("test-delay")}
-			shouldCreateEndpoint(t, server, delayEndpoint)
+			ordersEndpoint := &Endpoint{Site: site, Method: "GET", Path: "/users/*/orders/**", Response: []byte("orders")}
+			firstUserOrdersEndpoint := withPath(ordersEndpoint, "/users/1/orders/**")
+			firstUserOrdersEndpoint.Response = []byte("first-user-orders")
+			userEndpoint := withPath(ordersEndpoint, "/users/*")
+			userEndpoint.Response = []byte("user")
+			server.createEndpoint(ordersEndpoint)
+			server.createEndpoint(firstUserOrdersEndpoint)
+			server.createEndpoint(userEndpoint)
+
+			shouldRespondWith(t, ordersEndpoint.Response, server.makeRequestFor(withPath(ordersEndpoint, "/users/2/orders/3/items")))
+			shouldRespondWith(t, ordersEndpoint.Response, server.makeRequestFor(withPath(ordersEndpoint, "/users/2/orders")))
+			shouldRespondWith(t, firstUserOrdersEndpoint.Response, server.makeRequestFor(withPath(ordersEndpoint, "/users/1/orders/3")))
+			shouldRespondWith(t, userEndpoint.Response, server.makeRequestFor(withPath(ordersEndpoint, "/users/2")))
+			shouldRespondWithStatusCode(t, http.StatusNotFound,
+				server.makeRequestFor(withPath(ordersEndpoint, "/users/2/payments")))
+			shouldRespondWithStatusCode(t, http.StatusNotFound,
+				server.makeRequestFor(withPath(ordersEndpoint, "/users/")))
+		})
+	})
+}
 
-			shouldRespondInTimeInterval(t, 0.1, 0.15, server.makeRequestFor(delayEndpoint))
+func TestInvalidPathGlob(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			resp := server.createEndpoint(&Endpoint{Site: site, Path: "/a/["})
+			shouldHaveStatusCode(t, http.StatusBadRequest, resp)
 		})
 	})
 }
 
-func withNewSingleSiteServer(adminPathPrefix string, serverTest ServerTest) {
-	withNewServer(adminPathPrefix, serverTest)
+func TestEndpointRegexpPaths(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			itemEndpoint := &Endpoint{Site: site, Method: "GET", Path: `^/v[0-9]+/items/(?P<id>\d+)$`, PathIsRegexp: true,
+				Response: []byte(`{"id": $id}`)}
+			server.createEndpoint(itemEndpoint)
+
+			shouldRespondWith(t, []byte(`{"id": 42}`), server.makeRequestFor(withPath(itemEndpoint, "/v2/items/42")))
+			shouldRespondWithStatusCode(t, http.StatusNotFound,
+				server.makeRequestFor(withPath(itemEndpoint, "/v2/items/abc")))
+		})
+	})
 }
 
-func newGoSlowServer(driver string, adminPathPrefix string) *Server {
-	config := DEFAULT_CONFIG // copies DEFAULT_CONFIG
-	config.deployedOn = TEST_DEPLOYED_ON
-	config.driver = driver
-	config.dataSource = getDataSource(driver)
-	config.createDefaultEndpoints = (adminPathPrefix == "")
-	config.adminPathPrefix = adminPathPrefix
-	return NewServer(&config)
+func TestCompiledRegexpsAreBounded(t *testing.T) {
+	for i := 0; i < MAX_COMPILED_REGEXPS+10; i++ {
+		_, err := compileRegexp(fmt.Sprintf("^/items/%d$", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	re, err := compileRegexp("^/items/1$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringsShouldBeEqual(t, "^/items/1$", re.String())
+	compiledRegexps.Lock()
+	defer compiledRegexps.Unlock()
+	intsShouldBeEqual(t, MAX_COMPILED_REGEXPS, len(compiledRegexps.cache))
+	intsShouldBeEqual(t, MAX_COMPILED_REGEXPS, compiledRegexps.lru.Len())
 }
 
-func getDataSource(driver string) string {
-	dataSource, knownDriver := DATA_SOURCE[driver]
-	if !knownDriver {
-		log.Fatalf("unknown driver: <%s>", driver)
+func TestInvalidPathRegexp(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			resp := server.createEndpoint(&Endpoint{Site: site, Path: "^/items/(", PathIsRegexp: true})
+			shouldHaveStatusCode(t, http.StatusBadRequest, resp)
+		})
+	})
+}
+
+func TestEndpointPredicates(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			searchEndpoint := &Endpoint{Site: site, Method: "GET", Path: "/search", Response: []byte("any")}
+			equalsEndpoint := withPredicates(searchEndpoint, &Predicate{Source: "query", Name: "q", Kind: "equals", Value: "a"})
+			equalsEndpoint.Response = []byte("equals")
+			regexpEndpoint := withPredicates(searchEndpoint, &Predicate{Source: "query", Name: "q", Kind: "regexp", Value: "^b"})
+			regexpEndpoint.Response = []byte("regexp")
+			headerEndpoint := withPredicates(searchEndpoint, &Predicate{Source: "header", Name: "X-Api-Key", Kind: "present"})
+			headerEndpoint.Response = []byte("header")
+			for _, endpoint := range []*Endpoint{searchEndpoint, equalsEndpoint, regexpEndpoint, headerEndpoint} {
+				server.createEndpoint(endpoint)
+			}
+
+			shouldRespondWith(t, equalsEndpoint.Response, server.makeRequestFor(withPath(searchEndpoint, "/search?q=a")))
+			shouldRespondWith(t, regexpEndpoint.Response, server.makeRequestFor(withPath(searchEndpoint, "/search?q=bee")))
+			shouldRespondWith(t, searchEndpoint.Response, server.makeRequestFor(withPath(searchEndpoint, "/search?q=c")))
+			req := server.makeRequestFor(searchEndpoint)
+			req.Header.Set("X-Api-Key", "secret")
+			shouldRespondWith(t, headerEndpoint.Response, req)
+		})
+	})
+}
+
+func withPredicates(endpoint *Endpoint, predicates ...*Predicate) *Endpoint {
+	copy := *endpoint
+	copy.Predicates = predicates
+	return &copy
+}
+
+func TestEndpointBodyPredicates(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			usersEndpoint := &Endpoint{Site: site, Method: "POST", Path: "/users", Response: []byte("any")}
+			containsEndpoint := withPredicates(usersEndpoint, &Predicate{Source: "body", Kind: "contains", Value: "admin"})
+			containsEndpoint.Response = []byte("contains")
+			regexpEndpoint := withPredicates(usersEndpoint, &Predicate{Source: "body", Kind: "regexp", Value: "^guest-[0-9]+$"})
+			regexpEndpoint.Response = []byte("regexp")
+			jsonEndpoint := withPredicates(usersEndpoint, &Predicate{Source: "body", Name: "$.user.ids[1]", Kind: "json-equals", Value: "42"})
+			jsonEndpoint.Response = []byte("json")
+			for _, endpoint := range []*Endpoint{usersEndpoint, containsEndpoint, regexpEndpoint, jsonEndpoint} {
+				server.createEndpoint(endpoint)
+			}
+
+			shouldRespondWith(t, containsEndpoint.Response, server.makeRequestWithBody(usersEndpoint, "the admin"))
+			shouldRespondWith(t, regexpEndpoint.Response, server.makeRequestWithBody(usersEndpoint, "guest-17"))
+			shouldRespondWith(t, jsonEndpoint.Response, server.makeRequestWithBody(usersEndpoint, `{"user": {"ids": [1, 42]}}`))
+			shouldRespondWith(t, usersEndpoint.Response, server.makeRequestWithBody(usersEndpoint, `{"user": {"ids": [42]}}`))
+		})
+	})
+}
+
+func (server *TestServer) makeRequestWithBody(endpoint *Endpoint, body string) *http.Request {
+	return createRequest(getMethodForRequest(endpoint), server.getURL(), endpoint.Path,
+		makeFullDomain(endpoint.Site), strings.NewReader(body))
+}
+
+func TestJsonPath(t *testing.T) {
+	document := parseJsonValue(`{"users": [{"id": 1}, {"id": 2, "name": "bob"}]}`)
+
+	shouldFindInJson(t, document, "$.users[1].name", "bob")
+	shouldFindInJson(t, document, "$.users[0].id", float64(1))
+	_, found := lookupJsonPath(document, mustParseJsonPath(t, "$.users[2].id"))
+	if found {
+		t.Fatalf("$.users[2].id should not be found")
+	}
+	_, err := parseJsonPath("users.id")
+	if err == nil {
+		t.Fatalf("users.id should be an invalid JSON path")
 	}
-	return dataSource
 }
 
-// TODO: is it okay to have 3 string arguments?
-// TODO: shouldn't host argument come first or at least before path?
-// TODO: same for createGET, POST, and createPOST
-// TODO: rename host to domain everywhere?
-// TODO: GET, POST, createGET, createPOST, and createRequest should be the TestServer methods
-// and look like this: server.GET("0", "/")
-func GET(url, path, host string) *http.Response {
-	req := createGET(url, path, host)
-	return do(req)
+func shouldFindInJson(t *testing.T, document interface{}, jsonPath string, expected interface{}) {
+	actual, found := lookupJsonPath(document, mustParseJsonPath(t, jsonPath))
+	if !found || actual != expected {
+		t.Fatalf("%s: <<%v>> != <<%v>>", jsonPath, expected, actual)
+	}
 }
 
-func do(req *http.Request) *http.Response {
-	resp, err := new(http.Client).Do(req)
+func mustParseJsonPath(t *testing.T, jsonPath string) []interface{} {
+	path, err := parseJsonPath(jsonPath)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	return resp
+	return path
 }
 
-func createGET(url, path, host string) *http.Request {
-	return createRequest("GET", url, path, host, nil)
+func TestInvalidPredicate(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			resp := server.createEndpoint(&Endpoint{Site: site, Path: "/search",
+				Predicates: []*Predicate{{Source: "query", Name: "q", Kind: "regexp", Value: "("}}})
+			shouldHaveStatusCode(t, http.StatusBadRequest, resp)
+		})
+	})
 }
 
-// TODO: replace 4 string arguments with maybe template url.URL argument
-func createRequest(method, url, path, host string, body io.Reader) *http.Request {
-	// TODO: build url with url.URL.String() instead of string concatenation
-	req, err := http.NewRequest(method, url+path, body)
-	if err != nil {
-		log.Fatal(err)
+func TestPathSpecificity(t *testing.T) {
+	exact := &Endpoint{Path: "/users/1"}
+	wildcard := &Endpoint{Path: "/users/*"}
+	anySegments := &Endpoint{Path: "/users/**"}
+	anyPath := &Endpoint{Path: MATCHES_ANY_STRING, Method: "GET"}
+	regexpPath := &Endpoint{Path: "^/users/.*$", PathIsRegexp: true}
+
+	shouldBeMoreSpecific(t, exact, regexpPath)
+	shouldBeMoreSpecific(t, regexpPath, wildcard)
+	shouldBeMoreSpecific(t, exact, wildcard)
+	shouldBeMoreSpecific(t, wildcard, anySegments)
+	shouldBeMoreSpecific(t, anySegments, anyPath)
+	shouldBeMoreSpecific(t, withMethod(wildcard, "GET"), wildcard)
+}
+
+func shouldBeMoreSpecific(t *testing.T, endpoint, other *Endpoint) {
+	if !endpoint.Specificity().MoreSpecificThan(other.Specificity()) {
+		t.Fatalf("<<%s %s>> isn't more specific than <<%s %s>>",
+			endpoint.Method, endpoint.Path, other.Method, other.Path)
 	}
-	req.Host = host
-	return req
 }
 
-func read(resp *http.Response) []byte {
-	body, err := ioutil.ReadAll(resp.Body)
+func TestEndpointHeaders(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/headers", Response: []byte("{}"),
+				Headers: http.Header{"Content-Type": {"application/json"}, "Set-Cookie": {"a=1", "b=2"}}}
+			server.createEndpoint(endpoint)
+
+			resp := do(server.makeRequestFor(endpoint))
+			stringsShouldBeEqual(t, "application/json", resp.Header.Get("Content-Type"))
+			stringsShouldBeEqual(t, "a=1,b=2", strings.Join(resp.Header["Set-Cookie"], ","))
+		})
+	})
+}
+
+func TestEndpointHeadersFromRequestHeaders(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/headers", Response: []byte("{}")}
+			req := server.makeCreateEndpointRequest(endpoint)
+			req.Header.Set("X-Goslow-Header-Retry-After", "120")
+			do(req)
+
+			resp := do(server.makeRequestFor(endpoint))
+			stringsShouldBeEqual(t, "120", resp.Header.Get("Retry-After"))
+		})
+	})
+}
+
+func TestInvalidHeader(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			resp := server.createEndpoint(&Endpoint{Site: site, Path: "/headers", Headers: http.Header{"": {"no-name"}}})
+			shouldHaveStatusCode(t, http.StatusBadRequest, resp)
+		})
+	})
+}
+
+func TestOldHeadersFormat(t *testing.T) {
+	headers, err := jsonToHeaders(`{"Location": "//0.goslow.link"}`)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	return body
+	stringsShouldBeEqual(t, "//0.goslow.link", headers.Get("Location"))
 }
 
-func makeFullDomain(site string) string {
-	return fmt.Sprintf("%s.%s", site, TEST_DEPLOYED_ON)
+func TestEndpointDelay(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			delayEndpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Delay: time.Duration(100) * time.Millisecond, Response: []byte("test-delay")}
+			shouldCreateEndpoint(t, server, delayEndpoint)
+
+			shouldRespondInTimeInterval(t, 0.1, 0.15, server.makeRequestFor(delayEndpoint))
+		})
+	})
 }
 
-func bytesShouldBeEqual(t *testing.T, expected, actual []byte) {
-	if !bytes.Equal(expected, actual) {
-		t.Fatalf("<<%v>> != <<%v>>", string(expected), string(actual))
-	}
+func TestEndpointDelayDistribution(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			distribution := &DelayDistribution{Kind: "uniform",
+				Params: []time.Duration{100 * time.Millisecond, 150 * time.Millisecond}}
+			delayEndpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", DelayDistribution: distribution,
+				Response: []byte("test-delay")}
+			shouldCreateEndpoint(t, server, delayEndpoint)
+
+			shouldRespondInTimeInterval(t, 0.1, 0.2, server.makeRequestFor(delayEndpoint))
+		})
+	})
 }
 
-func intsShouldBeEqual(t *testing.T, expected, actual int) {
-	if expected != actual {
-		t.Fatalf("<<%v>> != <<%v>>", expected, actual)
-	}
+func TestEndpointBandwidth(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			trickleEndpoint := &Endpoint{Site: site, Method: "GET", Path: "/jquery.min.js",
+				Response: bytes.Repeat([]byte("j"), 100), BytesPerSecond: 500, ChunkSize: 25}
+			shouldCreateEndpoint(t, server, trickleEndpoint)
+
+			shouldRespondInTimeInterval(t, 0.2, 0.3, server.makeRequestFor(trickleEndpoint))
+		})
+	})
 }
 
-func shouldRespondInTimeInterval(t *testing.T, minSeconds, maxSeconds float64, req *http.Request) {
-	start := time.Now()
-	resp := do(req)
-	read(resp)
+func TestEndpointBodyDelay(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
 
-	duration := time.Since(start)
-	minDuration := secondsToDuration(minSeconds)
-	maxDuration := secondsToDuration(maxSeconds)
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Response: []byte("body"),
+				BodyDelay: 100 * time.Millisecond}
+			server.createEndpoint(endpoint)
 
-	if duration < minDuration || duration > maxDuration {
-		t.Fatalf("%s%s answered in %v. Not in the interval [%v; %v]",
-			req.Host, req.URL.Path, duration, minDuration, maxDuration)
+			start := time.Now()
+			resp := do(server.makeRequestFor(endpoint))
+			shouldTakeBetween(t, 0, 0.05, start)
+			bytesShouldBeEqual(t, endpoint.Response, read(resp))
+			shouldTakeBetween(t, 0.1, 0.15, start)
+		})
+	})
+}
+
+func TestEndpointStall(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Response: []byte("halfway"),
+				StallDelay: 100 * time.Millisecond, StallOffset: 4}
+			server.createEndpoint(endpoint)
+
+			start := time.Now()
+			resp := do(server.makeRequestFor(endpoint))
+			firstBytes := make([]byte, endpoint.StallOffset)
+			_, err := io.ReadFull(resp.Body, firstBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bytesShouldBeEqual(t, []byte("half"), firstBytes)
+			shouldTakeBetween(t, 0, 0.05, start)
+			bytesShouldBeEqual(t, []byte("way"), read(resp))
+			shouldTakeBetween(t, 0.1, 0.15, start)
+		})
+	})
+}
+
+func TestEndpointFaults(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			for _, fault := range []string{"reset", "close-before-headers"} {
+				endpoint := &Endpoint{Site: site, Method: "GET", Path: "/" + fault, Fault: fault}
+				server.createEndpoint(endpoint)
+				_, err := new(http.Client).Do(server.makeRequestFor(endpoint))
+				if err == nil {
+					t.Fatalf("fault %s: expecting an error", fault)
+				}
+			}
+
+			hangEndpoint := &Endpoint{Site: site, Method: "GET", Path: "/hang", Fault: "hang"}
+			server.createEndpoint(hangEndpoint)
+			client := &http.Client{Timeout: 100 * time.Millisecond}
+			_, err := client.Do(server.makeRequestFor(hangEndpoint))
+			if err == nil {
+				t.Fatal("fault hang: expecting a timeout")
+			}
+
+			truncateEndpoint := &Endpoint{Site: site, Method: "GET", Path: "/truncate", Fault: "truncate",
+				Response: []byte("truncated")}
+			server.createEndpoint(truncateEndpoint)
+			resp := do(server.makeRequestFor(truncateEndpoint))
+			_, err = ioutil.ReadAll(resp.Body)
+			if err != io.ErrUnexpectedEOF {
+				t.Fatalf("fault truncate: expecting %v, got %v", io.ErrUnexpectedEOF, err)
+			}
+		})
+	})
+}
+
+func TestEndpointVariants(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Response: []byte("ok"), Weight: 0,
+				Variants: []*Variant{{Weight: 1, StatusCode: 503, Response: []byte("oops;really")}}}
+			server.createEndpoint(endpoint)
+
+			resp := do(server.makeRequestFor(endpoint))
+			shouldHaveStatusCode(t, http.StatusServiceUnavailable, resp)
+			bytesShouldBeEqual(t, []byte("oops;really"), read(resp))
+		})
+	})
+}
+
+func TestVariantsDontInheritFaults(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			faulty := &Endpoint{Site: site, Method: "GET", Path: "/faulty", Fault: "reset", Weight: 0,
+				Variants: []*Variant{{Weight: 1, StatusCode: 200, Response: []byte("ok")}}}
+			server.createEndpoint(faulty)
+			shouldRespondWith(t, []byte("ok"), server.makeRequestFor(faulty))
+
+			flaky := &Endpoint{Site: site, Method: "GET", Path: "/flaky", Response: []byte("ok"), Weight: 0,
+				Variants: []*Variant{{Weight: 1, StatusCode: 200, Fault: "reset"}}}
+			server.createEndpoint(flaky)
+			_, err := new(http.Client).Do(server.makeRequestFor(flaky))
+			if err == nil {
+				t.Fatal("expecting an error")
+			}
+
+			truncated := &Endpoint{Site: site, Method: "GET", Path: "/truncated", Response: []byte("ok"), Weight: 0,
+				Variants: []*Variant{{Weight: 1, StatusCode: 200, Response: []byte("truncated"), Fault: "truncate"}}}
+			server.createEndpoint(truncated)
+			body, err := ioutil.ReadAll(do(server.makeRequestFor(truncated)).Body)
+			if err != io.ErrUnexpectedEOF || string(body) != "trun" {
+				t.Fatalf("expecting half of the variant response, got <%s> and %v", body, err)
+			}
+
+			template := &Endpoint{Site: site, Method: "GET", Path: "/template", Mode: TEMPLATE_MODE,
+				Response: []byte("{{ .Method }}"), Weight: 0,
+				Variants: []*Variant{{Weight: 1, StatusCode: 200, Response: []byte("{{ plain }}")}}}
+			server.createEndpoint(template)
+			shouldRespondWith(t, []byte("{{ plain }}"), server.makeRequestFor(template))
+		})
+	})
+}
+
+func TestSeededVariants(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			seed := int64(42)
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Response: []byte("ok"), Weight: 1, Seed: &seed,
+				Variants: []*Variant{{Weight: 1, StatusCode: 503}}}
+			server.createEndpoint(endpoint)
+			statusCodes := server.getStatusCodes(endpoint, 20)
+			server.createEndpoint(endpoint) // saving an endpoint resets its random values
+			stringsShouldBeEqual(t, statusCodes, server.getStatusCodes(endpoint, 20))
+			if !strings.Contains(statusCodes, "200") || !strings.Contains(statusCodes, "503") {
+				t.Fatalf("expecting both 200 and 503, got %s", statusCodes)
+			}
+		})
+	})
+}
+
+func (server *TestServer) getStatusCodes(endpoint *Endpoint, numRequests int) string {
+	statusCodes := make([]string, 0)
+	for i := 0; i < numRequests; i++ {
+		resp := do(server.makeRequestFor(endpoint))
+		read(resp)
+		statusCodes = append(statusCodes, fmt.Sprint(resp.StatusCode))
 	}
+	return strings.Join(statusCodes, ",")
 }
 
-// TODO: shouldn't all should* methods accept *http.Request and not *http.Response?
-func shouldHaveStatusCode(t *testing.T, statusCode int, resp *http.Response) {
-	intsShouldBeEqual(t, statusCode, resp.StatusCode)
+func TestEndpointSequence(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			unavailable := &Variant{StatusCode: 503}
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", StatusCode: 200,
+				Sequence: []*Variant{unavailable, unavailable}}
+			server.createEndpoint(endpoint)
+			stringsShouldBeEqual(t, "503,503,200,200", server.getStatusCodes(endpoint, 4))
+
+			endpoint.Loop = true
+			server.createEndpoint(endpoint) // saving an endpoint starts its sequence over
+			stringsShouldBeEqual(t, "503,503,200,503,503,200", server.getStatusCodes(endpoint, 6))
+		})
+	})
 }
 
-// TODO: build url with url.URL not Sprintf
-// TODO: endpoint is strange argument here, think of something better
-// TODO: add test for this function
-func createDomain(server *httptest.Server, endpoint *Endpoint) string {
-	resp := POST(server.URL, fmt.Sprintf("%s?output=short&method=GET", endpoint.Path),
-		makeFullDomain("create"), endpoint.Response)
-	return string(read(resp))
+func TestResetSequence(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", StatusCode: 200,
+				Sequence: []*Variant{{StatusCode: 503}}}
+			server.createEndpoint(endpoint)
+			stringsShouldBeEqual(t, "503,200", server.getStatusCodes(endpoint, 2))
+
+			req := server.makeCreateEndpointRequest(endpoint)
+			req.URL.RawQuery += "&action=reset"
+			shouldHaveStatusCode(t, http.StatusOK, do(req))
+			stringsShouldBeEqual(t, "503,200", server.getStatusCodes(endpoint, 2))
+
+			req = server.makeCreateEndpointRequest(withPath(endpoint, "/unknown"))
+			req.URL.RawQuery += "&action=reset"
+			shouldHaveStatusCode(t, http.StatusNotFound, do(req))
+		})
+	})
 }
 
-func POST(url, path, host string, payload []byte) *http.Response {
-	req := createPOST(url, path, host, payload)
-	return do(req)
+func TestRateLimiterForgetsOnlyExpiredWindows(t *testing.T) {
+	limiter := NewRateLimiter()
+	now := time.Now()
+	hourly := &Endpoint{Path: "/hourly", RateLimit: &RateLimit{Requests: 100, Interval: time.Hour}}
+	limiter.Take(hourly, httptest.NewRequest("GET", "/hourly", nil), now)
+	perSecond := &Endpoint{Path: "/per-second",
+		RateLimit: &RateLimit{Requests: 5, Interval: time.Second, Key: "header:X-Api-Key"}}
+	for i := 0; i <= MAX_RATE_LIMIT_WINDOWS; i++ {
+		req := httptest.NewRequest("GET", "/per-second", nil)
+		req.Header.Set("X-Api-Key", strconv.Itoa(i))
+		limiter.Take(perSecond, req, now.Add(2*time.Second))
+	}
+	status := limiter.Take(hourly, httptest.NewRequest("GET", "/hourly", nil), now.Add(2*time.Second))
+	intsShouldBeEqual(t, 98, status.Remaining)
 }
 
-func createPOST(url, path, host string, payload []byte) *http.Request {
-	return createRequest("POST", url, path, host, bytes.NewReader(payload))
+func TestRateLimit(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Response: []byte("ok"),
+				RateLimit: &RateLimit{Requests: 2, Interval: time.Minute, Response: []byte("slow down")}}
+			server.createEndpoint(endpoint)
+			stringsShouldBeEqual(t, "200,200,429", server.getStatusCodes(endpoint, 3))
+
+			resp := do(server.makeRequestFor(endpoint))
+			shouldHaveStatusCode(t, http.StatusTooManyRequests, resp)
+			bytesShouldBeEqual(t, []byte("slow down"), read(resp))
+			stringsShouldBeEqual(t, "2", resp.Header.Get("X-RateLimit-Limit"))
+			stringsShouldBeEqual(t, "0", resp.Header.Get("X-RateLimit-Remaining"))
+			retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+			if err != nil || retryAfter < 1 || retryAfter > 60 {
+				t.Fatalf("expecting Retry-After between 1 and 60, got <%s>", resp.Header.Get("Retry-After"))
+			}
+		})
+	})
 }
 
-func getSite(domain string) string {
-	return strings.Split(domain, ".")[0]
+func TestRateLimitByHeader(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Response: []byte("ok"),
+				RateLimit: &RateLimit{Requests: 1, Interval: time.Minute, Key: "header:X-Api-Key"}}
+			server.createEndpoint(endpoint)
+			for _, apiKey := range []string{"alice", "bob"} {
+				req := server.makeRequestFor(endpoint)
+				req.Header.Set("X-Api-Key", apiKey)
+				shouldHaveStatusCode(t, http.StatusOK, do(req))
+			}
+			req := server.makeRequestFor(endpoint)
+			req.Header.Set("X-Api-Key", "alice")
+			resp := do(req)
+			shouldHaveStatusCode(t, http.StatusTooManyRequests, resp)
+			bytesShouldBeEqual(t, []byte(DEFAULT_RATE_LIMIT_BODY), read(resp))
+		})
+	})
+}
+
+func TestInvalidRateLimit(t *testing.T) {
+	for _, rawRateLimit := range []string{"10", "0/60", "ten/60", "10/never", "10/-1s"} {
+		_, err := parseRateLimit(rawRateLimit, "", nil)
+		if err == nil {
+			t.Fatalf("rate limit <<%s>> should be invalid", rawRateLimit)
+		}
+	}
+	_, err := parseRateLimit("10/60", "cookie", nil)
+	if err == nil {
+		t.Fatal("rate limit key <<cookie>> should be invalid")
+	}
+}
+
+func TestTemplateMode(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "POST", Path: `/users/(?P<id>\d+)`, PathIsRegexp: true,
+				Mode: TEMPLATE_MODE,
+				Response: []byte(`{{ .Captures.id }} {{ .Query.q }} {{ index .Headers "X-Trace" }} ` +
+					`{{ .JSON.user.name }} {{ .Count }} {{ .Now.Year }}`)}
+			server.createEndpoint(endpoint)
+			server.goSlowServer.clock = &fakeClock{now: time.Date(2014, 12, 1, 18, 19, 1, 0, time.UTC)}
+
+			for _, expected := range []string{"42 goslow abc bob 1 2014", "42 goslow abc bob 2 2014"} {
+				req := createPOST(server.getURL(), "/users/42", makeFullDomain(site), []byte(`{"user": {"name": "bob"}}`))
+				req.URL.RawQuery = "q=goslow"
+				req.Header.Set("X-Trace", "abc")
+				shouldRespondWith(t, []byte(expected), req)
+			}
+		})
+	})
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	random := newLockedRandom(42)
+	tmpl, err := parseResponseTemplate([]byte(`{{ uuid }} {{ randInt 1 6 }} {{ json .Query }}`), random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response bytes.Buffer
+	err = tmpl.Execute(&response, &RequestData{Query: map[string]string{"q": "goslow"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(response.String(), " ")
+	uuidPattern := "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$"
+	if !regexp.MustCompile(uuidPattern).MatchString(parts[0]) {
+		t.Fatalf("expecting uuid, got %s", parts[0])
+	}
+	dice, err := strconv.Atoi(parts[1])
+	if err != nil || dice < 1 || dice > 6 {
+		t.Fatalf("expecting int in [1, 6], got %s", parts[1])
+	}
+	stringsShouldBeEqual(t, `{"q":"goslow"}`, parts[2])
+}
+
+func TestInvalidTemplate(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			resp := server.createEndpoint(&Endpoint{Site: site, Path: "/test", Mode: TEMPLATE_MODE,
+				Response: []byte("{{ .Query.q ")})
+			shouldHaveStatusCode(t, http.StatusBadRequest, resp)
+			resp = server.createEndpoint(&Endpoint{Site: site, Path: "/test", Mode: "magic"})
+			shouldHaveStatusCode(t, http.StatusBadRequest, resp)
+		})
+	})
+}
+
+func TestEchoMode(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "POST", Path: "/echo", Mode: ECHO_MODE, StatusCode: 201}
+			server.createEndpoint(endpoint)
+
+			req := server.makeRequestWithBody(endpoint, `{"user": "bob"}`)
+			req.URL.RawQuery = "q=goslow"
+			req.Header.Set("X-Real-IP", "10.0.0.1")
+			resp := do(req)
+			shouldHaveStatusCode(t, http.StatusCreated, resp)
+			stringsShouldBeEqual(t, "application/json", resp.Header.Get("Content-Type"))
+			echo := &EchoData{}
+			err := json.Unmarshal(read(resp), echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stringsShouldBeEqual(t, "POST /echo goslow 10.0.0.1 HTTP/1.1",
+				strings.Join([]string{echo.Method, echo.Path, echo.Query.Get("q"), echo.ClientIP, echo.Protocol}, " "))
+			stringsShouldBeEqual(t, `{"user": "bob"}`, echo.Body)
+			stringsShouldBeEqual(t, req.Host, echo.Host)
+			stringsShouldBeEqual(t, "bob", fmt.Sprint(echo.JSON.(map[string]interface{})["user"]))
+		})
+	})
+}
+
+func TestRequestLog(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "POST", Path: "/users/*", Response: []byte("ok")}
+			server.createEndpoint(endpoint)
+			req := createPOST(server.getURL(), "/users/1?q=goslow", makeFullDomain(site), []byte("alice"))
+			req.Header.Set("Authorization", "Bearer secret")
+			do(req)
+			do(createPOST(server.getURL(), "/users/2", makeFullDomain(site), []byte("bob")))
+			do(createGET(server.getURL(), "/unknown", makeFullDomain(site)))
+
+			requests := server.getLoggedRequests(t, site, url.Values{})
+			paths := make([]string, 0)
+			for _, request := range requests {
+				paths = append(paths, request.Path)
+			}
+			stringsShouldBeEqual(t, "/users/1,/users/2,/unknown", strings.Join(paths, ","))
+			stringsShouldBeEqual(t, "alice", requests[0].Body)
+			stringsShouldBeEqual(t, "goslow", requests[0].Query.Get("q"))
+			stringsShouldBeEqual(t, "POST /users/*", requests[0].Endpoint)
+			stringsShouldBeEqual(t, "", requests[2].Endpoint)
+			stringsShouldBeEqual(t, REDACTED_HEADER_VALUE, requests[0].Headers.Get("Authorization"))
+
+			filtered := server.getLoggedRequests(t, site, url.Values{"method": {"POST"}, "limit": {"1"}})
+			if len(filtered) != 1 || filtered[0].Body != "bob" {
+				t.Fatalf("expecting the last POST request, got %+v", filtered)
+			}
+			filtered = server.getLoggedRequests(t, site, url.Values{"request_path": {"/unknown"}})
+			if len(filtered) != 1 || filtered[0].Method != "GET" {
+				t.Fatalf("expecting the GET /unknown request, got %+v", filtered)
+			}
+
+			shouldHaveStatusCode(t, http.StatusOK, server.doAction(site, "clear_requests", url.Values{}))
+			if len(server.getLoggedRequests(t, site, url.Values{})) != 0 {
+				t.Fatal("expecting no requests after clear_requests")
+			}
+		})
+	})
+}
+
+func TestRequestLogIsBounded(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			server.goSlowServer.config.maxLoggedRequests = 2
+			endpoint := &Endpoint{Site: site, Method: "POST", Path: "/test", Response: []byte("ok")}
+			server.createEndpoint(endpoint)
+			for _, body := range []string{"1", "2", "3"} {
+				do(server.makeRequestWithBody(endpoint, body))
+			}
+			requests := server.getLoggedRequests(t, site, url.Values{})
+			if len(requests) != 2 || requests[0].Body != "2" || requests[1].Body != "3" {
+				t.Fatalf("expecting the latest 2 requests, got %+v", requests)
+			}
+		})
+	})
+}
+
+func TestVerifyExpectations(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			server.createEndpoint(&Endpoint{Site: site, Method: "POST", Path: "/charge", Response: []byte("ok")})
+			server.doActionOn(site, "/charge", "expect",
+				url.Values{"method": {"POST"}, "match_body": {"amount=100"}, "times": {"1"}})
+			server.doActionOn(site, "/refund", "expect", url.Values{"max_times": {"0"}})
+
+			do(createPOST(server.getURL(), "/charge", makeFullDomain(site), []byte("amount=100")))
+			verification := server.verify(t, site, http.StatusOK)
+			if !verification.Passed || verification.Expectations[0].Actual != 1 {
+				t.Fatalf("expecting verification to pass, got %+v", verification)
+			}
+
+			do(createPOST(server.getURL(), "/charge", makeFullDomain(site), []byte("amount=100")))
+			do(createGET(server.getURL(), "/health", makeFullDomain(site)))
+			verification = server.verify(t, site, http.StatusExpectationFailed)
+			result := verification.Expectations[0]
+			stringsShouldBeEqual(t, "exactly 1 time", result.Expected)
+			if result.Passed || result.Actual != 2 {
+				t.Fatalf("expecting 2 calls to fail the expectation, got %+v", result)
+			}
+			if len(verification.Unexpected) != 1 || verification.Unexpected[0].Path != "/health" {
+				t.Fatalf("expecting unexpected GET /health, got %+v", verification.Unexpected)
+			}
+
+			server.doAction(site, "clear_requests", url.Values{})
+			server.doAction(site, "clear_expectations", url.Values{})
+			server.verify(t, site, http.StatusOK)
+		})
+	})
+}
+
+func TestVerifyIsInconclusiveWhenRequestsAreForgotten(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			server.goSlowServer.config.maxLoggedRequests = 2
+			do(createGET(server.getURL(), "/health", makeFullDomain(site)))
+			do(createGET(server.getURL(), "/health", makeFullDomain(site)))
+			server.doActionOn(site, "/charge", "expect", url.Values{"times": {"1"}})
+			do(createGET(server.getURL(), "/charge", makeFullDomain(site)))
+			verification := server.verify(t, site, http.StatusExpectationFailed)
+			if verification.Inconclusive {
+				t.Fatalf("expecting requests before the expectation not to matter, got %+v", verification)
+			}
+
+			do(createGET(server.getURL(), "/charge", makeFullDomain(site)))
+			do(createGET(server.getURL(), "/charge", makeFullDomain(site)))
+			verification = server.verify(t, site, http.StatusExpectationFailed)
+			if !verification.Inconclusive || verification.Passed {
+				t.Fatalf("expecting an inconclusive verification, got %+v", verification)
+			}
+
+			server.doAction(site, "clear_requests", url.Values{})
+			do(createGET(server.getURL(), "/charge", makeFullDomain(site)))
+			verification = server.verify(t, site, http.StatusOK)
+			if verification.Inconclusive {
+				t.Fatalf("expecting clear_requests to make the verification conclusive, got %+v", verification)
+			}
+		})
+	})
+}
+
+func TestVerifyNeedsRequestLog(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			server.goSlowServer.config.maxLoggedRequests = 0
+			server.doActionOn(site, "/charge", "expect", url.Values{"max_times": {"0"}})
+			shouldHaveStatusCode(t, http.StatusConflict, server.doAction(site, "verify", url.Values{}))
+		})
+	})
+}
+
+func TestInvalidExpectedTimes(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			resp := server.doActionOn(site, "/charge", "expect", url.Values{"min_times": {"2"}, "max_times": {"1"}})
+			shouldHaveStatusCode(t, http.StatusBadRequest, resp)
+			resp = server.doActionOn(site, "/charge", "expect", url.Values{"times": {"-1"}})
+			shouldHaveStatusCode(t, http.StatusBadRequest, resp)
+		})
+	})
+}
+
+func TestProxyMode(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(w, "upstream %s %s %s", req.Method, req.URL.Path, body)
+	}))
+	defer upstream.Close()
+
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			resp := server.doAction(site, "proxy", url.Values{"upstream": {upstream.URL}, "delay": {"0.2"}})
+			shouldHaveStatusCode(t, http.StatusOK, resp)
+			server.createEndpoint(&Endpoint{Site: site, Method: "GET", Path: "/stub", Response: []byte("stub")})
+
+			start := time.Now()
+			shouldRespondWith(t, []byte("upstream POST /users hi"),
+				createPOST(server.getURL(), "/users", makeFullDomain(site), []byte("hi")))
+			shouldTakeBetween(t, 0.2, 0.4, start)
+			shouldRespondWith(t, []byte("stub"), createGET(server.getURL(), "/stub", makeFullDomain(site)))
+
+			server.doAction(site, "proxy", url.Values{"upstream": {upstream.URL}, "error_rate": {"1"},
+				"error_status": {"503"}})
+			resp = do(createGET(server.getURL(), "/users", makeFullDomain(site)))
+			shouldHaveStatusCode(t, http.StatusServiceUnavailable, resp)
+
+			server.doAction(site, "proxy", url.Values{"upstream": {""}})
+			resp = do(createGET(server.getURL(), "/users", makeFullDomain(site)))
+			shouldHaveStatusCode(t, http.StatusNotFound, resp)
+		})
+	})
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			calls := 0
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				calls++
+				w.Header().Set("X-Upstream", "real")
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprintf(w, "real %s", req.URL.Query().Get("q"))
+			}))
+			server.doAction(site, "record", url.Values{"upstream": {upstream.URL}})
+
+			for i := 0; i < 2; i++ {
+				for _, q := range []string{"a", "b"} {
+					resp := do(createGET(server.getURL(), "/search?q="+q, makeFullDomain(site)))
+					shouldHaveStatusCode(t, http.StatusCreated, resp)
+					stringsShouldBeEqual(t, "real", resp.Header.Get("X-Upstream"))
+					bytesShouldBeEqual(t, []byte("real "+q), read(resp))
+				}
+			}
+			if calls != 2 {
+				t.Fatalf("expecting 2 calls to the upstream, got %d", calls)
+			}
+			upstream.Close()
+
+			server.doAction(site, "replay", url.Values{"delay": {"0.2"}})
+			start := time.Now()
+			shouldRespondWith(t, []byte("real b"), createGET(server.getURL(), "/search?q=b", makeFullDomain(site)))
+			shouldTakeBetween(t, 0.2, 0.4, start)
+			resp := do(createGET(server.getURL(), "/search?q=c", makeFullDomain(site)))
+			shouldHaveStatusCode(t, http.StatusNotFound, resp)
+		})
+	})
+}
+
+func TestRecordingKeepsRequestsApart(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				fmt.Fprintf(w, "real %s %s", req.URL.RequestURI(), body)
+			}))
+			server.doAction(site, "record", url.Values{"upstream": {upstream.URL}})
+			domain := makeFullDomain(site)
+			requests := []func() *http.Request{
+				func() *http.Request { return createGET(server.getURL(), "/items", domain) },
+				func() *http.Request { return createGET(server.getURL(), "/items?page=2", domain) },
+				func() *http.Request { return createPOST(server.getURL(), "/items", domain, []byte("first")) },
+				func() *http.Request { return createPOST(server.getURL(), "/items", domain, []byte("second")) },
+				func() *http.Request { return createGET(server.getURL(), "/files/*.txt", domain) },
+			}
+			expected := []string{"real /items ", "real /items?page=2 ", "real /items first", "real /items second",
+				"real /files/*.txt "}
+			for i, request := range requests {
+				shouldRespondWith(t, []byte(expected[i]), request())
+			}
+			upstream.Close()
+
+			server.doAction(site, "replay", url.Values{})
+			for i, request := range requests {
+				shouldRespondWith(t, []byte(expected[i]), request())
+			}
+			for _, req := range []*http.Request{
+				createGET(server.getURL(), "/items?page=3", domain),
+				createPOST(server.getURL(), "/items", domain, []byte("third")),
+				createGET(server.getURL(), "/files/a.txt", domain),
+			} {
+				shouldHaveStatusCode(t, http.StatusNotFound, do(req))
+			}
+		})
+	})
+}
+
+func TestInvalidProxy(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			for _, params := range []url.Values{
+				{"upstream": {"localhost:8080"}},
+				{"upstream": {"ftp://example.com"}},
+				{"upstream": {"http://example.com"}, "error_rate": {"1.5"}},
+				{"upstream": {"http://example.com"}, "error_status": {"oops"}},
+			} {
+				shouldHaveStatusCode(t, http.StatusBadRequest, server.doAction(site, "proxy", params))
+			}
+		})
+	})
+}
+
+func TestProxyIsOffByDefault(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			server.goSlowServer.config.allowProxy = false
+			resp := server.doAction(site, "proxy", url.Values{"upstream": {"http://example.com"}})
+			shouldHaveStatusCode(t, http.StatusForbidden, resp)
+		})
+	})
+}
+
+func TestProxyRefusesPrivateUpstreams(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "private")
+	}))
+	defer upstream.Close()
+
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			server.goSlowServer.config.allowPrivateUpstreams = false
+			for _, rawUpstream := range []string{upstream.URL, "http://localhost:8080", "http://10.0.0.1",
+				"http://169.254.169.254/latest/meta-data", "http://[::1]:8080", "http://0.0.0.0"} {
+				resp := server.doAction(site, "proxy", url.Values{"upstream": {rawUpstream}})
+				shouldHaveStatusCode(t, http.StatusForbidden, resp)
+			}
+		})
+	})
+
+	// e.g the upstream host resolved to a public address when the proxy was configured
+	client := &http.Client{Transport: newUpstreamTransport(false)}
+	_, err := client.Get(upstream.URL)
+	if err == nil {
+		t.Fatalf("expecting the transport to refuse connecting to %s", upstream.URL)
+	}
+}
+
+func TestDeleteEndpoint(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			getEndpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Response: []byte("test-get")}
+			postEndpoint := &Endpoint{Site: site, Method: "POST", Path: "/test", Response: []byte("test-post")}
+			shouldCreateEndpoint(t, server, getEndpoint)
+			shouldCreateEndpoint(t, server, postEndpoint)
+
+			shouldHaveStatusCode(t, http.StatusOK,
+				server.doActionOn(site, "/test", "delete", url.Values{"method": {"GET"}}))
+			shouldRespondWithStatusCode(t, http.StatusNotFound, server.makeRequestFor(getEndpoint))
+			shouldRespondWith(t, postEndpoint.Response, server.makeRequestFor(postEndpoint))
+			shouldHaveStatusCode(t, http.StatusNotFound,
+				server.doActionOn(site, "/test", "delete", url.Values{"method": {"GET"}}))
+
+			// the response isn't a part of the key, so stall_at beyond the empty body doesn't matter
+			shouldHaveStatusCode(t, http.StatusOK,
+				server.doActionOn(site, "/test", "delete", url.Values{"method": {"POST"}, "stall_at": {"5"}}))
+			shouldRespondWithStatusCode(t, http.StatusNotFound, server.makeRequestFor(postEndpoint))
+		})
+	})
+}
+
+func TestClearEndpoints(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Response: []byte("test")}
+			shouldCreateEndpoint(t, server, endpoint)
+			shouldHaveStatusCode(t, http.StatusOK, server.doAction(site, "clear", url.Values{}))
+			shouldRespondWithStatusCode(t, http.StatusNotFound, server.makeRequestFor(endpoint))
+			shouldCreateEndpoint(t, server, endpoint)
+		})
+	})
+}
+
+func TestDeleteSite(t *testing.T) {
+	withNewMultiSiteServer(func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Response: []byte("test")}
+			shouldCreateEndpoint(t, server, endpoint)
+			shouldHaveStatusCode(t, http.StatusOK, server.doAction(site, "delete_site", url.Values{}))
+			shouldRespondWithStatusCode(t, http.StatusNotFound, server.makeRequestFor(endpoint))
+			dontAllowToChangeSite(t, server, http.StatusNotFound, site)
+			shouldHaveStatusCode(t, http.StatusNotFound, server.doAction(site, "requests", url.Values{}))
+		})
+	})
+	withNewServer("/goslow", func(server *TestServer) {
+		shouldHaveStatusCode(t, http.StatusForbidden, server.doAction(EMPTY_SITE, "delete_site", url.Values{}))
+	})
+}
+
+func TestListEndpoints(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", StatusCode: 201, Delay: time.Second,
+				Headers: http.Header{"X-Test": {"yes"}}, Response: []byte("listed")}
+			shouldCreateEndpoint(t, server, endpoint)
+
+			req := server.makeListEndpointsRequest(site)
+			resp := do(req)
+			shouldHaveStatusCode(t, http.StatusOK, resp)
+			text := string(read(resp))
+			for _, expected := range []string{"GET /test responds with 201 after 1s delay.", "Header X-Test: yes",
+				"Response is: listed"} {
+				if !strings.Contains(text, expected) {
+					t.Fatalf("<<%s>> doesn't contain <<%s>>", text, expected)
+				}
+			}
+
+			req = server.makeListEndpointsRequest(site)
+			req.Header.Set("Accept", "application/json")
+			resources := make([]*EndpointResource, 0)
+			server.decodeApiResponse(t, do(req), &resources)
+			resource := resources[len(resources)-1]
+			stringsShouldBeEqual(t, "/test", resource.Path)
+			stringsShouldBeEqual(t, "listed", resource.Response)
+
+			req = server.makeListEndpointsRequest(site)
+			req.URL.Path = strings.TrimSuffix(req.URL.Path, "/") + "/test"
+			text = string(read(do(req)))
+			if strings.Contains(text, "Response is: listed") {
+				t.Fatalf("only the admin root lists endpoints, but GET /test responded with <<%s>>", text)
+			}
+		})
+	})
+}
+
+func (server *TestServer) makeListEndpointsRequest(site string) *http.Request {
+	req := server.makeCreateEndpointRequest(&Endpoint{Site: site, Path: "/"})
+	req.Method = "GET"
+	req.Body = nil
+	return req
+}
+
+func TestEndpointApi(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			created := server.callApi(t, site, "POST", "", `{"Path": "/users/*", "Method": "GET", `+
+				`"StatusCode": 201, "Response": "created", "Headers": {"X-Api": ["yes"]}}`, http.StatusCreated)
+			resp := do(createGET(server.getURL(), "/users/42", makeFullDomain(site)))
+			shouldHaveStatusCode(t, http.StatusCreated, resp)
+			stringsShouldBeEqual(t, "yes", resp.Header.Get("X-Api"))
+			bytesShouldBeEqual(t, []byte("created"), read(resp))
+
+			server.callApi(t, site, "POST", "", `{"Path": "/users/*", "Method": "GET"}`, http.StatusConflict)
+			resources := make([]*EndpointResource, 0)
+			server.decodeApiResponse(t, do(server.makeApiRequest(site, "GET", "", "")), &resources)
+			found := false
+			for _, resource := range resources {
+				found = found || resource.Id == created.Id
+			}
+			if !found {
+				t.Fatalf("endpoint %s isn't listed", created.Id)
+			}
+
+			updated := server.callApi(t, site, "PUT", created.Id,
+				`{"Path": "/orders/*", "Response": "updated"}`, http.StatusOK)
+			shouldRespondWith(t, []byte("updated"), createGET(server.getURL(), "/orders/1", makeFullDomain(site)))
+			server.callApi(t, site, "GET", created.Id, "", http.StatusNotFound)
+			resource := server.callApi(t, site, "GET", updated.Id, "", http.StatusOK)
+			stringsShouldBeEqual(t, "/orders/*", resource.Path)
+			intsShouldBeEqual(t, http.StatusOK, resource.StatusCode)
+
+			server.callApi(t, site, "DELETE", updated.Id, "", http.StatusNoContent)
+			server.callApi(t, site, "DELETE", updated.Id, "", http.StatusNotFound)
+			resp = do(createGET(server.getURL(), "/orders/1", makeFullDomain(site)))
+			shouldHaveStatusCode(t, http.StatusNotFound, resp)
+		})
+	})
+}
+
+func TestInvalidApiRequests(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			for _, body := range []string{
+				`{"Path": "/"`,
+				`{"Path": "/", "Unknown": true}`,
+				`{"Path": "/", "StatusCode": 42}`,
+				`{"Path": "(", "PathIsRegexp": true}`,
+				`{"Path": "/", "Fault": "oops"}`,
+				`{"Path": "/", "Delay": 1000000000000}`,
+				`{"Path": "/", "Predicates": [{"Source": "cookie", "Name": "id", "Kind": "present"}]}`,
+				`{"Path": "/", "RateLimit": {"Requests": 0, "Interval": 1000000000}}`,
+				`{"Path": "/", "Predicates": [null]}`,
+				`{"Path": "/", "Variants": [null]}`,
+				`{"Path": "/", "Sequence": [{"StatusCode": 200}, null]}`,
+				`{"Path": "/", "Outage": {"Windows": [null]}}`,
+			} {
+				server.callApi(t, site, "POST", "", body, http.StatusBadRequest)
+			}
+			server.callApi(t, site, "GET", "oops", "", http.StatusNotFound)
+			server.callApi(t, site, "PATCH", "", "", http.StatusMethodNotAllowed)
+		})
+	})
+}
+
+func TestEndpointsCanUseApiPaths(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/api/v1/users", Response: []byte("users")}
+			server.callApi(t, site, "POST", "", `{"Path": "/api/v1/users", "Method": "GET", "Response": "users"}`,
+				http.StatusCreated)
+			shouldRespondWith(t, []byte("users"), server.makeRequestFor(endpoint))
+		})
+	})
+}
+
+func TestApiHasTheSamePathInBothModes(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			domain := makeFullDomain("admin-" + site)
+			if server.isInSingleSiteMode() {
+				domain = makeFullDomain(EMPTY_SITE)
+			}
+			req := createPOST(server.getURL(), "/goslow/api/v1/endpoints", domain,
+				[]byte(`{"Path": "/users", "Method": "GET", "Response": "users"}`))
+			resp := do(req)
+			shouldHaveStatusCode(t, http.StatusCreated, resp)
+			if !strings.HasPrefix(resp.Header.Get("Location"), "/goslow/api/v1/endpoints/") {
+				t.Fatalf("unexpected Location %s", resp.Header.Get("Location"))
+			}
+			shouldRespondWith(t, []byte("users"), server.makeRequestFor(&Endpoint{Site: site, Path: "/users"}))
+		})
+	})
+}
+
+// TestServer.callApi checks the status code and returns the decoded EndpointResource or ApiError.
+func (server *TestServer) callApi(t *testing.T, site, method, id, body string,
+	expectedStatusCode int) *EndpointResource {
+	resp := do(server.makeApiRequest(site, method, id, body))
+	shouldHaveStatusCode(t, expectedStatusCode, resp)
+	resource := &EndpointResource{}
+	switch {
+	case expectedStatusCode == http.StatusNoContent:
+	case expectedStatusCode >= http.StatusBadRequest:
+		apiError := &ApiError{}
+		server.decodeApiResponse(t, resp, apiError)
+		if apiError.StatusCode != expectedStatusCode || apiError.Message == "" {
+			t.Fatalf("unexpected API error %+v", apiError)
+		}
+	default:
+		server.decodeApiResponse(t, resp, resource)
+	}
+	return resource
+}
+
+func (server *TestServer) makeApiRequest(site, method, id, body string) *http.Request {
+	path := API_ROOT + ENDPOINTS_API_PATH
+	domain := makeFullDomain("admin-" + site)
+	if server.isInSingleSiteMode() {
+		domain = makeFullDomain(EMPTY_SITE)
+		path = join(server.getAdminPathPrefix(), ENDPOINTS_API_PATH)
+	}
+	if id != "" {
+		path += "/" + id
+	}
+	return createRequest(method, server.getURL(), path, domain, strings.NewReader(body))
+}
+
+func (server *TestServer) decodeApiResponse(t *testing.T, resp *http.Response, value interface{}) {
+	stringsShouldBeEqual(t, "application/json", resp.Header.Get("Content-Type"))
+	err := json.Unmarshal(read(resp), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			dir := makeTempDir(t)
+			defer os.RemoveAll(dir)
+			writeFile(t, filepath.Join(dir, "users.json"), `{"users": []}`)
+			path := writeFile(t, filepath.Join(dir, "goslow.yml"), server.makeConfigFile(site, `
+    - path: /users
+      method: GET
+      status: 201
+      headers: {Content-Type: application/json}
+      body_file: users.json
+    - path: /slow
+      delay: 0.2
+      body: slow
+    - path: /user
+      body: {id: 1, tags: [admin]}
+`))
+			loader := NewConfigLoader(server.goSlowServer, path)
+			err := loader.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := do(createGET(server.getURL(), "/users", makeFullDomain(site)))
+			shouldHaveStatusCode(t, http.StatusCreated, resp)
+			stringsShouldBeEqual(t, "application/json", resp.Header.Get("Content-Type"))
+			bytesShouldBeEqual(t, []byte(`{"users": []}`), read(resp))
+			start := time.Now()
+			shouldRespondWith(t, []byte("slow"), createGET(server.getURL(), "/slow", makeFullDomain(site)))
+			shouldTakeBetween(t, 0.2, 0.4, start)
+			shouldRespondWith(t, []byte(`{"id":1,"tags":["admin"]}`),
+				createGET(server.getURL(), "/user", makeFullDomain(site)))
+
+			writeFile(t, filepath.Join(dir, "users.json"), `{"users": [1]}`)
+			writeFile(t, path, server.makeConfigFile(site, `
+    - path: /users
+      method: GET
+      body_file: users.json
+`))
+			if !loader.hasChanged() {
+				t.Fatal("changed config file isn't noticed")
+			}
+			err = loader.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			shouldRespondWith(t, []byte(`{"users": [1]}`), createGET(server.getURL(), "/users", makeFullDomain(site)))
+			shouldRespondWithStatusCode(t, http.StatusNotFound, createGET(server.getURL(), "/slow", makeFullDomain(site)))
+		})
+	})
+}
+
+func TestInvalidConfigFile(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			dir := makeTempDir(t)
+			defer os.RemoveAll(dir)
+			for _, endpoints := range []string{
+				"\n    - path: /\n      delay: forever\n",
+				"\n    - path: /\n      unknown: true\n",
+				"\n    - path: /\n      body: a\n      body_file: a.txt\n",
+				"\n    - path: /\n      body_file: missing.txt\n",
+				"\n    - path: /\n    - path: /\n",
+				"\n    - path: /\n      body: {1: one}\n",
+			} {
+				path := writeFile(t, filepath.Join(dir, "goslow.yml"), server.makeConfigFile(site, endpoints))
+				err := NewConfigLoader(server.goSlowServer, path).Load()
+				if err == nil || !strings.Contains(err.Error(), "line 4") {
+					t.Fatalf("expecting an error at line 4, got %v", err)
+				}
+			}
+			path := writeFile(t, filepath.Join(dir, "goslow.json"), `{"sites": [{"name": "`+site+`", "endpoints": [
+  {"path": "/", "status": "oops"}]}]}`)
+			err := NewConfigLoader(server.goSlowServer, path).Load()
+			if err == nil || !strings.Contains(err.Error(), "line 2") {
+				t.Fatalf("expecting an error at line 2, got %v", err)
+			}
+		})
+	})
+}
+
+// TestServer.makeConfigFile returns YAML with the site endpoints, the first endpoint is at line 4.
+func (server *TestServer) makeConfigFile(site, endpoints string) string {
+	name := ""
+	if !server.isInSingleSiteMode() {
+		name = "name: " + site
+	}
+	return fmt.Sprintf("sites:\n  - %s\n    endpoints:%s", name, endpoints)
+}
+
+func makeTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "goslow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) string {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExportImport(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			binary := &Endpoint{Site: site, Method: "GET", Path: "/binary", Response: []byte{0, 1, 255}}
+			search := withPredicates(&Endpoint{Site: site, Method: "GET", Path: "/search", Response: []byte("found")},
+				&Predicate{Source: QUERY_PREDICATE, Name: "q", Kind: EQUALS_PREDICATE, Value: "goslow"})
+			shouldCreateEndpoint(t, server, binary)
+			server.createEndpoint(search)
+			resp := server.doAction(site, "export", url.Values{})
+			shouldHaveStatusCode(t, http.StatusOK, resp)
+			exported := read(resp)
+			bundle, err := decodeBundle(bytes.NewReader(exported))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stringsShouldBeEqual(t, site, bundle.Site)
+
+			extra := &Endpoint{Site: site, Method: "GET", Path: "/extra", Response: []byte("extra")}
+			shouldCreateEndpoint(t, server, extra)
+			req := server.makeCreateEndpointRequest(&Endpoint{Site: site, Path: "/"})
+			req.URL.RawQuery = "action=import&replace=true"
+			req.Body = ioutil.NopCloser(bytes.NewReader(exported))
+			shouldHaveStatusCode(t, http.StatusOK, do(req))
+			shouldRespondWith(t, binary.Response, server.makeRequestFor(binary))
+			shouldRespondWith(t, search.Response, server.makeRequestFor(withPath(search, "/search?q=goslow")))
+			shouldRespondWithStatusCode(t, http.StatusNotFound, server.makeRequestFor(extra))
+
+			if server.isInSingleSiteMode() {
+				return
+			}
+			resp = POST(server.getURL(), "/?action=import&output=short", makeFullDomain("create"), exported)
+			shouldHaveStatusCode(t, http.StatusOK, resp)
+			copied := *binary
+			copied.Site = getSubdomain(string(read(resp)))
+			shouldRespondWith(t, binary.Response, server.makeRequestFor(&copied))
+		})
+	})
+}
+
+func TestInvalidBundle(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			valid := `{"Path": "/valid", "Method": "GET", "StatusCode": 200, "Weight": 1}`
+			for _, bundle := range []string{
+				`{"version": 1, "site": "", "endpoints": [` + valid + `, {"Path": "/invalid", "StatusCode": 42}]}`,
+				`{"version": 2, "site": "", "endpoints": [` + valid + `]}`,
+				`{"version": 1,`,
+				`{"version": 1, "site": "", "endpoints": [` + valid + `, null]}`,
+			} {
+				req := server.makeCreateEndpointRequest(&Endpoint{Site: site, Path: "/"})
+				req.URL.RawQuery = "action=import"
+				req.Body = ioutil.NopCloser(strings.NewReader(bundle))
+				shouldHaveStatusCode(t, http.StatusBadRequest, do(req))
+			}
+			shouldRespondWithStatusCode(t, http.StatusNotFound,
+				server.makeRequestFor(&Endpoint{Site: site, Method: "GET", Path: "/valid"}))
+		})
+	})
+}
+
+func TestExportImportSubcommands(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	config := DEFAULT_CONFIG // copies DEFAULT_CONFIG
+	config.dataSource = filepath.Join(dir, "goslow.db")
+	bundle := `{"version": 1, "site": "laptop", "endpoints": [{"Path": "/test", "Method": "GET", "StatusCode": 201,
+	  "Response": "aGVsbG8=", "Weight": 1}]}`
+	var output bytes.Buffer
+	err := runSubcommand(&config, []string{"import", "--replace", "shared"}, strings.NewReader(bundle), &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.Reset()
+	err = runSubcommand(&config, []string{"export", "shared"}, nil, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := decodeBundle(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringsShouldBeEqual(t, "shared", exported.Site)
+	intsShouldBeEqual(t, 1, len(exported.Endpoints))
+	bytesShouldBeEqual(t, []byte("hello"), exported.Endpoints[0].Response)
+	intsShouldBeEqual(t, 201, exported.Endpoints[0].StatusCode)
+
+	err = runSubcommand(&config, []string{"export", "unknown"}, nil, &output)
+	apiError, isApiError := err.(*ApiError)
+	if !isApiError || apiError.StatusCode != http.StatusNotFound {
+		t.Fatalf("expecting an unknown site error, got %v", err)
+	}
+}
+
+func TestSubcommandsNeedPersistentDatabase(t *testing.T) {
+	config := DEFAULT_CONFIG // copies DEFAULT_CONFIG
+	for _, args := range [][]string{{"export"}, {"import"}, {"openapi"}} {
+		var output bytes.Buffer
+		err := runSubcommand(&config, args, strings.NewReader(""), &output)
+		if err == nil || !strings.Contains(err.Error(), "persistent database") {
+			t.Fatalf("expecting %s to refuse the in-memory database, got %v", args[0], err)
+		}
+	}
+}
+
+const PETS_SPEC = `
+openapi: 3.0.3
+servers:
+  - url: https://pets.example.com/v1
+paths:
+  /pets:
+    get:
+      responses:
+        200:
+          content:
+            application/json:
+              examples:
+                cats: {value: [{id: 1, name: Tom}]}
+    post:
+      responses:
+        201:
+          content:
+            application/json:
+              schema: {$ref: "#/components/schemas/Pet"}
+        400:
+          description: invalid pet
+  /pets/{petId}:
+    get:
+      responses:
+        default: {$ref: "#/components/responses/Pet"}
+        404:
+          description: not found
+    delete:
+      responses:
+        204:
+          description: deleted
+  /health:
+    get:
+      responses:
+        2XX:
+          content:
+            text/plain:
+              example: ok
+components:
+  schemas:
+    Pet:
+      type: object
+      properties:
+        id: {type: integer, example: 42}
+        name: {type: string}
+        born: {type: string, format: date}
+        friends: {type: array, items: {$ref: "#/components/schemas/Pet"}}
+  responses:
+    Pet:
+      content:
+        application/json:
+          schema: {$ref: "#/components/schemas/Pet"}
+`
+
+func TestOpenApi(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			req := server.makeCreateEndpointRequest(&Endpoint{Site: site, Path: "/"})
+			req.URL.RawQuery = "action=openapi&delay=0.2"
+			req.Body = ioutil.NopCloser(strings.NewReader(PETS_SPEC))
+			shouldHaveStatusCode(t, http.StatusOK, do(req))
+
+			pets := &Endpoint{Site: site, Method: "GET", Path: "/v1/pets"}
+			shouldRespondWith(t, []byte(`[{"id":1,"name":"Tom"}]`), server.makeRequestFor(pets))
+			shouldRespondInTimeInterval(t, 0.2, 0.4, server.makeRequestFor(pets))
+			resp := do(server.makeRequestFor(&Endpoint{Site: site, Method: "POST", Path: "/v1/pets"}))
+			shouldHaveStatusCode(t, http.StatusCreated, resp)
+			stringsShouldBeEqual(t, "application/json", resp.Header.Get("Content-Type"))
+			pet := make(map[string]interface{})
+			err := json.Unmarshal(read(resp), &pet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shouldFindInJson(t, pet, "$.id", 42.0)
+			shouldFindInJson(t, pet, "$.born", "2015-10-21")
+			shouldFindInJson(t, pet, "$.friends[0].name", "string")
+			shouldRespondWithStatusCode(t, http.StatusOK,
+				server.makeRequestFor(&Endpoint{Site: site, Method: "GET", Path: "/v1/pets/42"}))
+			shouldRespondWithStatusCode(t, http.StatusNoContent,
+				server.makeRequestFor(&Endpoint{Site: site, Method: "DELETE", Path: "/v1/pets/42"}))
+			resp = do(server.makeRequestFor(&Endpoint{Site: site, Method: "GET", Path: "/v1/health"}))
+			stringsShouldBeEqual(t, "text/plain", resp.Header.Get("Content-Type"))
+			bytesShouldBeEqual(t, []byte("ok"), read(resp))
+
+			if server.isInSingleSiteMode() {
+				return
+			}
+			resp = POST(server.getURL(), "/?action=openapi&output=short", makeFullDomain("create"), []byte(PETS_SPEC))
+			shouldHaveStatusCode(t, http.StatusOK, resp)
+			health := &Endpoint{Site: getSubdomain(string(read(resp))), Method: "GET", Path: "/v1/health"}
+			shouldRespondWith(t, []byte("ok"), server.makeRequestFor(health))
+		})
+	})
+}
+
+func TestInvalidOpenApiSpec(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			for _, spec := range []string{
+				`{"swagger": "2.0", "paths": {}}`,
+				`{"openapi": "3.0.0", "paths": {"/valid": {"get": {}}, "/invalid": {"get": {"responses": {"200": {"$ref": "other.yml#/Pet"}}}}}}`,
+				`{"openapi": "3.0.0", "paths": {"/valid": {"get": {"responses": {"OK": {}}}}}}`,
+				`openapi: [3.0.0`,
+				`{"openapi": "3.0.0", "servers": [null], "paths": {"/valid": {"get": {}}}}`,
+				`{"openapi": "3.0.0", "servers": [{"url": "/{v}", "variables": {"v": null}}], "paths": {"/valid": {"get": {}}}}`,
+				`{"openapi": "3.0.0", "paths": {"/valid": {"get": {"responses": {"200": {"content": {"application/json": {"examples": {"a": null}}}}}}}}}`,
+				`{"openapi": "3.0.0", "paths": {"/valid": {"get": {"responses": {"200": {"content": {"application/json": {"examples": {"a": {"$ref": "#/components/examples/a"}}}}}}}}}, "components": {"examples": {"a": null}}}`,
+			} {
+				req := server.makeCreateEndpointRequest(&Endpoint{Site: site, Path: "/"})
+				req.URL.RawQuery = "action=openapi"
+				req.Body = ioutil.NopCloser(strings.NewReader(spec))
+				shouldHaveStatusCode(t, http.StatusBadRequest, do(req))
+			}
+			shouldRespondWithStatusCode(t, http.StatusNotFound,
+				server.makeRequestFor(&Endpoint{Site: site, Method: "GET", Path: "/valid"}))
+		})
+	})
+}
+
+func TestOpenApiSpecWithNulls(t *testing.T) {
+	spec := `
+openapi: 3.0.0
+paths:
+  /empty:
+  /users/{id}:
+    get:
+      responses:
+        "200":
+          content:
+            application/json:
+              schema:
+                properties:
+                  id:
+                    type: integer
+                  name:
+                  role:
+                    oneOf: [null]
+                  meta:
+                    allOf: [null, {properties: {tags: {type: array}}}]
+                  nickname:
+                    anyOf: [null]
+`
+	decoded, err := decodeOpenApiSpec(strings.NewReader(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := decoded.toBundle(EMPTY_SITE, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intsShouldBeEqual(t, 1, len(bundle.Endpoints))
+	stringsShouldBeEqual(t, `{"id":0,"meta":{"tags":[]},"name":null,"nickname":null,"role":null}`,
+		string(bundle.Endpoints[0].Response))
+}
+
+func TestOpenApiSubcommand(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	config := DEFAULT_CONFIG // copies DEFAULT_CONFIG
+	config.dataSource = filepath.Join(dir, "goslow.db")
+	var output bytes.Buffer
+	err := runSubcommand(&config, []string{"openapi", "--delay", "2.5", "pets"}, strings.NewReader(PETS_SPEC), &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.Reset()
+	err = runSubcommand(&config, []string{"export", "pets"}, nil, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := decodeBundle(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intsShouldBeEqual(t, 5, len(exported.Endpoints))
+	for _, endpoint := range exported.Endpoints {
+		intsShouldBeEqual(t, 2500, int(endpoint.Delay/time.Millisecond))
+	}
+}
+
+func (server *TestServer) verify(t *testing.T, site string, expectedStatusCode int) *Verification {
+	resp := server.doAction(site, "verify", url.Values{})
+	shouldHaveStatusCode(t, expectedStatusCode, resp)
+	verification := &Verification{}
+	err := json.Unmarshal(read(resp), verification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verification
+}
+
+// TestServer.doAction makes an admin request with the action param.
+func (server *TestServer) doAction(site, action string, params url.Values) *http.Response {
+	return server.doActionOn(site, "/", action, params)
+}
+
+func (server *TestServer) doActionOn(site, path, action string, params url.Values) *http.Response {
+	req := server.makeCreateEndpointRequest(&Endpoint{Site: site, Path: path})
+	params.Set("action", action)
+	req.URL.RawQuery = params.Encode()
+	return do(req)
+}
+
+func (server *TestServer) getLoggedRequests(t *testing.T, site string, params url.Values) []*LoggedRequest {
+	resp := server.doAction(site, "requests", params)
+	shouldHaveStatusCode(t, http.StatusOK, resp)
+	requests := make([]*LoggedRequest, 0)
+	err := json.Unmarshal(read(resp), &requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return requests
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func TestOutageSchedule(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			clock := &fakeClock{now: time.Date(2014, 12, 1, 18, 0, 10, 0, time.UTC)}
+			server.goSlowServer.clock = clock
+			endpoint := &Endpoint{Site: site, Method: "GET", Path: "/test", Response: []byte("ok"),
+				Outage: &OutageSchedule{
+					Windows:  []*OutageWindow{{Length: 30 * time.Second, Period: 5 * time.Minute}},
+					Response: &Variant{StatusCode: 500, Response: []byte("down")}}}
+			server.createEndpoint(endpoint)
+
+			resp := do(server.makeRequestFor(endpoint))
+			shouldHaveStatusCode(t, http.StatusInternalServerError, resp)
+			bytesShouldBeEqual(t, []byte("down"), read(resp))
+
+			clock.now = clock.now.Add(time.Minute)
+			shouldRespondWith(t, []byte("ok"), server.makeRequestFor(endpoint))
+
+			clock.now = clock.now.Add(4 * time.Minute)
+			shouldHaveStatusCode(t, http.StatusInternalServerError, do(server.makeRequestFor(endpoint)))
+		})
+	})
+}
+
+func TestDailyOutageWindow(t *testing.T) {
+	window, err := parseOutageWindow("23:50-00:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringsShouldBeEqual(t, "daily 23:50-00:10 UTC", window.String())
+	for _, now := range []time.Time{
+		time.Date(2014, 12, 1, 23, 55, 0, 0, time.UTC),
+		time.Date(2014, 12, 2, 0, 5, 0, 0, time.UTC),
+	} {
+		if !window.IsActive(now) {
+			t.Fatalf("expecting outage at %s", now)
+		}
+	}
+	if window.IsActive(time.Date(2014, 12, 2, 0, 15, 0, 0, time.UTC)) {
+		t.Fatal("expecting no outage at 00:15")
+	}
+}
+
+func TestInvalidOutage(t *testing.T) {
+	for _, rawWindow := range []string{"30s", "5m/30s", "30s/5m@5m", "0/5m", "25:00-26:00", "09:00-09:00", "x/5m"} {
+		_, err := parseOutageWindow(rawWindow)
+		if err == nil {
+			t.Fatalf("outage <<%s>> should be invalid", rawWindow)
+		}
+	}
+}
+
+func TestInvalidVariant(t *testing.T) {
+	for _, rawVariant := range []string{"weight=-1", "status=abc", "color=red", "header=no-colon", "delay=1000"} {
+		_, err := parseVariant(rawVariant)
+		if err == nil {
+			t.Fatalf("variant <<%s>> should be invalid", rawVariant)
+		}
+	}
+}
+
+func TestUnknownFault(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			resp := server.createEndpoint(&Endpoint{Site: site, Path: "/test", Fault: "explode"})
+			shouldHaveStatusCode(t, http.StatusBadRequest, resp)
+		})
+	})
+}
+
+func shouldTakeBetween(t *testing.T, minSeconds, maxSeconds float64, start time.Time) {
+	duration := time.Since(start)
+	if duration < secondsToDuration(minSeconds) || duration > secondsToDuration(maxSeconds) {
+		t.Fatalf("took %v. Not in the interval [%vs; %vs]", duration, minSeconds, maxSeconds)
+	}
+}
+
+func TestInvalidBandwidth(t *testing.T) {
+	withServers([]string{MULTI_SITE_MODE, "/goslow"}, func(server *TestServer) {
+		server.withNewSite(func(site string) {
+
+			resp := server.createEndpoint(&Endpoint{Site: site, Path: "/test", BytesPerSecond: -1})
+			shouldHaveStatusCode(t, http.StatusBadRequest, resp)
+		})
+	})
+}
+
+func TestInvalidDelayDistribution(t *testing.T) {
+	for _, rawDelay := range []string{"uniform(3,1)", "normal(1)", "gamma(1,2)", "p99=1s,p50=2s", "p50=1000s", "-1s"} {
+		_, _, err := parseDelay(rawDelay)
+		if err == nil {
+			t.Fatalf("delay <<%s>> should be invalid", rawDelay)
+		}
+	}
+}
+
+func TestDelayDistributionString(t *testing.T) {
+	for _, rawDelay := range []string{"uniform(1s,3s)", "normal(200ms,50ms)", "exponential(500ms)", "p50=200ms,p99.9=5s"} {
+		_, distribution, err := parseDelay(rawDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stringsShouldBeEqual(t, rawDelay, distribution.String())
+	}
+}
+
+func TestSeededDelays(t *testing.T) {
+	seed := int64(42)
+	endpoint := &Endpoint{Path: "/test", Seed: &seed,
+		DelayDistribution: &DelayDistribution{Kind: "exponential", Params: []time.Duration{time.Second}}}
+
+	randoms := NewRandomSources()
+	first := endpoint.SampleDelay(randoms.For(endpoint))
+	second := endpoint.SampleDelay(randoms.For(endpoint))
+	randoms.Reset(endpoint)
+	intsShouldBeEqual(t, int(first), int(endpoint.SampleDelay(randoms.For(endpoint))))
+	intsShouldBeEqual(t, int(second), int(endpoint.SampleDelay(randoms.For(endpoint))))
+}
+
+func TestPercentilesDelay(t *testing.T) {
+	_, distribution, err := parseDelay("p50=200ms,p100=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	intsShouldBeEqual(t, int(100*time.Millisecond), int(time.Duration(distribution.samplePercentiles(25))))
+	intsShouldBeEqual(t, int(600*time.Millisecond), int(time.Duration(distribution.samplePercentiles(75))))
+}
+
+func withNewSingleSiteServer(adminPathPrefix string, serverTest ServerTest) {
+	withNewServer(adminPathPrefix, serverTest)
+}
+
+// BASELINE_SCHEMA is the schema of goslow databases before migrations.
+const BASELINE_SCHEMA = `
+CREATE TABLE sites(
+  site TEXT PRIMARY KEY
+);
+
+CREATE TABLE endpoints (
+  site        TEXT,
+  path        TEXT,
+  method      TEXT,
+  headers     TEXT,
+  delay       BIGINT,
+  status_code INT,
+  response    BLOB,
+  PRIMARY KEY(site, path, method),
+  FOREIGN KEY(site) REFERENCES sites(site)
+);
+
+INSERT INTO sites (site) VALUES ('legacy');
+
+INSERT INTO endpoints (site, path, method, headers, delay, status_code, response)
+VALUES ('legacy', '/old', 'GET', '{"Content-Type": "text/plain"}', 0, 201, 'old');
+`
+
+func TestMigrations(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	dataSource := filepath.Join(dir, "goslow.db")
+	db, err := sql.Open("sqlite3", dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(BASELINE_SCHEMA)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := shouldOpenStorage(t, dataSource)
+	endpoints, err := storage.GetEndpoints("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	intsShouldBeEqual(t, 1, len(endpoints))
+	old := endpoints[0]
+	bytesShouldBeEqual(t, []byte("old"), old.Response)
+	intsShouldBeEqual(t, 201, old.StatusCode)
+	if old.Headers.Get("Content-Type") != "text/plain" {
+		t.Fatalf("expecting the legacy headers to be kept, got %v", old.Headers)
+	}
+	intsShouldBeEqual(t, DEFAULT_WEIGHT, old.Weight)
+	withPredicate := withPredicates(old, &Predicate{Source: QUERY_PREDICATE, Name: "q", Kind: PRESENT_PREDICATE})
+	err = storage.SaveEndpoint(withPredicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site, _, err := storage.GetSite("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site.Upstream != "" {
+		t.Fatalf("expecting the legacy site not to be a proxy, got %+v", site)
+	}
+	storage.db.Close()
+
+	// migrations are applied once
+	storage = shouldOpenStorage(t, dataSource)
+	defer storage.db.Close()
+	version, err := storage.getSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	intsShouldBeEqual(t, len(MIGRATIONS), version)
+	endpoints, err = storage.GetEndpoints("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	intsShouldBeEqual(t, 2, len(endpoints))
+}
+
+func shouldOpenStorage(t *testing.T, dataSource string) *Storage {
+	storage, err := NewStorage("sqlite3", dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func newGoSlowServer(driver string, adminPathPrefix string) *Server {
+	config := DEFAULT_CONFIG // copies DEFAULT_CONFIG
+	config.deployedOn = TEST_DEPLOYED_ON
+	config.driver = driver
+	config.dataSource = getDataSource(driver)
+	config.createDefaultEndpoints = (adminPathPrefix == "")
+	config.adminPathPrefix = adminPathPrefix
+	config.maxLoggedRequests = TEST_MAX_LOGGED_REQUESTS
+	// upstreams of the proxy tests are at localhost
+	config.allowProxy = true
+	config.allowPrivateUpstreams = true
+	return NewServer(&config)
+}
+
+func getDataSource(driver string) string {
+	dataSource, knownDriver := DATA_SOURCE[driver]
+	if !knownDriver {
+		log.Fatalf("unknown driver: <%s>", driver)
+	}
+	return dataSource
+}
+
+// TODO: is it okay to have 3 string arguments?
+// TODO: shouldn't host argument come first or at least before path?
+// TODO: same for createGET, POST, and createPOST
+// TODO: rename host to domain everywhere?
+// TODO: GET, POST, createGET, createPOST, and createRequest should be the TestServer methods
+// and look like this: server.GET("0", "/")
+func GET(url, path, host string) *http.Response {
+	req := createGET(url, path, host)
+	return do(req)
+}
+
+func do(req *http.Request) *http.Response {
+	resp, err := new(http.Client).Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return resp
+}
+
+func createGET(url, path, host string) *http.Request {
+	return createRequest("GET", url, path, host, nil)
+}
+
+// TODO: replace 4 string arguments with maybe template url.URL argument
+func createRequest(method, url, path, host string, body io.Reader) *http.Request {
+	// TODO: build url with url.URL.String() instead of string concatenation
+	req, err := http.NewRequest(method, url+path, body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Host = host
+	return req
+}
+
+func read(resp *http.Response) []byte {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return body
+}
+
+func makeFullDomain(site string) string {
+	return fmt.Sprintf("%s.%s", site, TEST_DEPLOYED_ON)
+}
+
+func bytesShouldBeEqual(t *testing.T, expected, actual []byte) {
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("<<%v>> != <<%v>>", string(expected), string(actual))
+	}
+}
+
+func stringsShouldBeEqual(t *testing.T, expected, actual string) {
+	if expected != actual {
+		t.Fatalf("<<%v>> != <<%v>>", expected, actual)
+	}
+}
+
+func intsShouldBeEqual(t *testing.T, expected, actual int) {
+	if expected != actual {
+		t.Fatalf("<<%v>> != <<%v>>", expected, actual)
+	}
+}
+
+func shouldRespondInTimeInterval(t *testing.T, minSeconds, maxSeconds float64, req *http.Request) {
+	start := time.Now()
+	resp := do(req)
+	read(resp)
+
+	duration := time.Since(start)
+	minDuration := secondsToDuration(minSeconds)
+	maxDuration := secondsToDuration(maxSeconds)
+
+	if duration < minDuration || duration > maxDuration {
+		t.Fatalf("%s%s answered in %v. Not in the interval [%v; %v]",
+			req.Host, req.URL.Path, duration, minDuration, maxDuration)
+	}
+}
+
+// TODO: shouldn't all should* methods accept *http.Request and not *http.Response?
+func shouldHaveStatusCode(t *testing.T, statusCode int, resp *http.Response) {
+	intsShouldBeEqual(t, statusCode, resp.StatusCode)
+}
+
+// TODO: build url with url.URL not Sprintf
+// TODO: endpoint is strange argument here, think of something better
+// TODO: add test for this function
+func createDomain(server *httptest.Server, endpoint *Endpoint) string {
+	resp := POST(server.URL, fmt.Sprintf("%s?output=short&method=GET", endpoint.Path),
+		makeFullDomain("create"), endpoint.Response)
+	return string(read(resp))
+}
+
+func POST(url, path, host string, payload []byte) *http.Response {
+	req := createPOST(url, path, host, payload)
+	return do(req)
+}
+
+func createPOST(url, path, host string, payload []byte) *http.Request {
+	return createRequest("POST", url, path, host, bytes.NewReader(payload))
+}
+
+func getSite(domain string) string {
+	return strings.Split(domain, ".")[0]
 }
 
 func getQueryString(endpoint *Endpoint) string {
 	params := url.Values{}
 	params.Set("method", endpoint.Method)
 	params.Set("delay", fmt.Sprintf("%f", endpoint.Delay.Seconds()))
+	if endpoint.StatusCode != 0 {
+		params.Set("status", fmt.Sprint(endpoint.StatusCode))
+	}
+	if endpoint.DelayDistribution != nil {
+		params.Set("delay", endpoint.DelayDistribution.String())
+	}
+	if endpoint.Seed != nil {
+		params.Set("seed", fmt.Sprint(*endpoint.Seed))
+	}
+	if endpoint.BytesPerSecond != 0 {
+		params.Set("bandwidth", fmt.Sprint(endpoint.BytesPerSecond))
+	}
+	if endpoint.ChunkSize != 0 {
+		params.Set("chunk_size", fmt.Sprint(endpoint.ChunkSize))
+	}
+	if endpoint.BodyDelay != 0 {
+		params.Set("body_delay", endpoint.BodyDelay.String())
+	}
+	if len(endpoint.Variants) > 0 {
+		params.Set("weight", fmt.Sprint(endpoint.Weight))
+	}
+	for _, variant := range endpoint.Variants {
+		rawVariant := fmt.Sprintf("weight=%d;status=%d;delay=%s;", variant.Weight, variant.StatusCode, variant.Delay)
+		if variant.Fault != NO_FAULT {
+			rawVariant += "fault=" + variant.Fault + ";"
+		}
+		params.Add("variant", rawVariant+"body="+string(variant.Response))
+	}
+	for _, step := range endpoint.Sequence {
+		params.Add("step", fmt.Sprintf("status=%d;delay=%s;body=%s", step.StatusCode, step.Delay, step.Response))
+	}
+	if endpoint.Loop {
+		params.Set("loop", "true")
+	}
+	if endpoint.Outage != nil {
+		for _, window := range endpoint.Outage.Windows {
+			params.Add("outage", fmt.Sprintf("%s/%s@%s", window.Length, window.Period, window.Offset))
+		}
+		response := endpoint.Outage.Response
+		params.Set("outage_response", fmt.Sprintf("status=%d;body=%s", response.StatusCode, response.Response))
+	}
+	if endpoint.Mode != STATIC_MODE {
+		params.Set("mode", endpoint.Mode)
+	}
+	if endpoint.RateLimit != nil {
+		params.Set("rate_limit", fmt.Sprintf("%d/%s", endpoint.RateLimit.Requests, endpoint.RateLimit.Interval))
+		params.Set("rate_limit_key", endpoint.RateLimit.Key)
+		params.Set("rate_limit_body", string(endpoint.RateLimit.Response))
+	}
+	if endpoint.Fault != NO_FAULT {
+		params.Set("fault", endpoint.Fault)
+	}
+	if endpoint.StallDelay != 0 {
+		params.Set("stall_delay", endpoint.StallDelay.String())
+		params.Set("stall_at", fmt.Sprint(endpoint.StallOffset))
+	}
+	if endpoint.PathIsRegexp {
+		params.Set("path_regex", endpoint.Path)
+	}
+	for _, predicate := range endpoint.Predicates {
+		params.Add(getPredicateParam(predicate), getRawPredicate(predicate))
+	}
+	for name, values := range endpoint.Headers {
+		for _, value := range values {
+			params.Add("header", name+":"+value)
+		}
+	}
 	return params.Encode()
 }
 
+func getPredicateParam(predicate *Predicate) string {
+	if predicate.Source != BODY_PREDICATE {
+		return "match_" + predicate.Source
+	}
+	switch predicate.Kind {
+	case REGEXP_PREDICATE:
+		return "match_body_regex"
+	case JSON_EQUALS_PREDICATE:
+		return "match_json"
+	}
+	return "match_body"
+}
+
+func getRawPredicate(predicate *Predicate) string {
+	switch {
+	case predicate.Source == BODY_PREDICATE && predicate.Kind == JSON_EQUALS_PREDICATE:
+		return predicate.Name + "==" + predicate.Value
+	case predicate.Source == BODY_PREDICATE:
+		return predicate.Value
+	}
+	switch predicate.Kind {
+	case EQUALS_PREDICATE:
+		return predicate.Name + "=" + predicate.Value
+	case REGEXP_PREDICATE:
+		return predicate.Name + "~" + predicate.Value
+	}
+	return predicate.Name
+}
+
 // Wrapper around path.Join. Preserves trailing slash.
 func join(elem ...string) string {
 	lastElem := elem[len(elem)-1]
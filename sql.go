@@ -1,10 +1,15 @@
 package main
 
+import "fmt"
+
 // To make queries work with both sqlite3 and postgres:
 // a) string " BYTEA," is replaced with " BLOB," in DDL statements
-// b) strings "$1", "$2", "$3", ... are replaced with "? in DML statements
+// b) string " SERIAL PRIMARY KEY," is replaced with " INTEGER PRIMARY KEY AUTOINCREMENT," in DDL statements
+// c) strings "$1", "$2", "$3", ... are replaced with "? in DML statements
 // when using sqlite3 driver.
 const (
+	// CREATE_SCHEMA_IF_NOT_EXISTS_SQL is the schema of goslow before migrations,
+	// the current schema is this one with all the MIGRATIONS applied.
 	CREATE_SCHEMA_IF_NOT_EXISTS_SQL = `
 CREATE TABLE IF NOT EXISTS sites(
   site TEXT PRIMARY KEY
@@ -21,33 +26,229 @@ CREATE TABLE IF NOT EXISTS endpoints (
   PRIMARY KEY(site, path, method),
   FOREIGN KEY(site) REFERENCES sites(site)
 );
+
+CREATE TABLE IF NOT EXISTS schema_version (
+  version INT
+);
+`
+
+	GET_SCHEMA_VERSION_SQL = `
+SELECT version
+FROM schema_version
+`
+
+	INSERT_SCHEMA_VERSION_SQL = `
+INSERT INTO schema_version
+       (version)
+VALUES ($1)
+`
+
+	UPDATE_SCHEMA_VERSION_SQL = `
+UPDATE schema_version
+SET version = $1
+`
+
+	// predicates are a part of the primary key, and primary key can't be altered in sqlite
+	REBUILD_ENDPOINTS_SQL = `
+CREATE TABLE endpoints_rebuilt (
+  site        TEXT,
+	path        TEXT,
+	path_is_regexp BOOLEAN DEFAULT FALSE,
+	method      TEXT,
+	predicates  TEXT DEFAULT '[]',
+	headers     TEXT,
+  delay       BIGINT,
+	status_code INT,
+	response    BYTEA,
+  PRIMARY KEY(site, path, method, predicates),
+  FOREIGN KEY(site) REFERENCES sites(site)
+);
+
+INSERT INTO endpoints_rebuilt
+SELECT site, path, path_is_regexp, method, predicates, headers, delay, status_code, response
+FROM endpoints;
+
+DROP TABLE endpoints;
+
+ALTER TABLE endpoints_rebuilt RENAME TO endpoints;
+`
+
+	CREATE_REQUESTS_TABLE_SQL = `
+CREATE TABLE requests (
+  id          SERIAL PRIMARY KEY,
+  site        TEXT,
+	method      TEXT,
+	path        TEXT,
+	query       TEXT,
+	headers     TEXT,
+	body        BYTEA,
+	endpoint    TEXT,
+	delay       BIGINT,
+	received_at BIGINT
+);
+`
+
+	// index for GET_LAST_TRIMMED_REQUEST_ID_SQL and TRIM_REQUESTS_SQL, which run on every logged request
+	CREATE_REQUESTS_INDEX_SQL = `
+CREATE INDEX IF NOT EXISTS requests_site_id ON requests(site, id)
+`
+
+	CREATE_EXPECTATIONS_TABLE_SQL = `
+CREATE TABLE expectations (
+  id          SERIAL PRIMARY KEY,
+  site        TEXT,
+	path        TEXT,
+	path_is_regexp BOOLEAN,
+	method      TEXT,
+	predicates  TEXT,
+	min_times   INT,
+	max_times   INT
+);
 `
 
 	DELETE_ENDPOINT_SQL = `
 DELETE FROM endpoints
-WHERE site   = $1
-  AND path   = $2
-	AND method = $3
+WHERE site       = $1
+  AND path       = $2
+	AND method     = $3
+	AND predicates = $4
 `
 
 	INSERT_ENDPOINT_SQL = `
 INSERT INTO endpoints
-       (site, path, method, headers, delay, status_code, response)
-VALUES ($1,   $2,   $3,     $4,      $5,    $6,          $7)
+       (site, path, path_is_regexp, method, predicates, headers, delay, delay_distribution, seed, status_code, response,
+        bytes_per_second, chunk_size, body_delay, stall_delay, stall_offset, fault, weight, variants,
+        sequence, loop_sequence, rate_limit, outage, mode)
+VALUES ($1,   $2,   $3,             $4,     $5,         $6,      $7,    $8,                 $9,   $10,         $11,
+        $12,              $13,        $14,        $15,         $16,          $17,   $18,    $19,
+        $20,      $21,           $22,        $23,    $24)
 `
 
 	GET_SITE_ENDPOINTS_SQL = `
-SELECT site, path, method, headers, delay, status_code, response
+SELECT site, path, path_is_regexp, method, predicates, headers, delay, delay_distribution, seed, status_code, response,
+       bytes_per_second, chunk_size, body_delay, stall_delay, stall_offset, fault, weight, variants,
+       sequence, loop_sequence, rate_limit, outage, mode
 FROM endpoints
 WHERE site = $1
-ORDER BY LENGTH(path)   DESC,
-         LENGTH(method) DESC
+ORDER BY path,
+         method,
+         predicates
+`
+
+	GET_ENDPOINT_SQL = `
+SELECT site, path, path_is_regexp, method, predicates, headers, delay, delay_distribution, seed, status_code, response,
+       bytes_per_second, chunk_size, body_delay, stall_delay, stall_offset, fault, weight, variants,
+       sequence, loop_sequence, rate_limit, outage, mode
+FROM endpoints
+WHERE site       = $1
+  AND path       = $2
+	AND method     = $3
+	AND predicates = $4
+`
+
+	INSERT_REQUEST_SQL = `
+INSERT INTO requests
+       (site, method, path, query, headers, body, endpoint, delay, received_at)
+VALUES ($1,   $2,     $3,   $4,    $5,      $6,   $7,       $8,    $9)
+`
+
+	// the newest request that doesn't fit into the latest $2 requests of the site
+	GET_LAST_TRIMMED_REQUEST_ID_SQL = `
+SELECT id
+FROM requests
+WHERE site = $1
+ORDER BY id DESC
+LIMIT 1 OFFSET $2
+`
+
+	TRIM_REQUESTS_SQL = `
+DELETE FROM requests
+WHERE site = $1
+  AND id  <= $2
+`
+
+	SET_LAST_TRIMMED_REQUEST_ID_SQL = `
+UPDATE sites
+SET last_trimmed_request_id = $1
+WHERE site = $2
+`
+
+	GET_LAST_TRIMMED_REQUEST_ID_OF_SITE_SQL = `
+SELECT last_trimmed_request_id
+FROM sites
+WHERE site = $1
+`
+
+	GET_SITE_REQUESTS_SQL = `
+SELECT id, site, method, path, query, headers, body, endpoint, delay, received_at
+FROM requests
+WHERE site = $1
+ORDER BY id
+`
+
+	DELETE_SITE_REQUESTS_SQL = `
+DELETE FROM requests
+WHERE site = $1
+`
+
+	// last_request_id is the latest logged request (of any site) when the expectation is added
+	INSERT_EXPECTATION_SQL = `
+INSERT INTO expectations
+       (site, path, path_is_regexp, method, predicates, min_times, max_times, last_request_id)
+VALUES ($1,   $2,   $3,             $4,     $5,         $6,        $7,        (SELECT COALESCE(MAX(id), 0)
+                                                                              FROM requests))
+`
+
+	GET_SITE_EXPECTATIONS_SQL = `
+SELECT id, site, path, path_is_regexp, method, predicates, min_times, max_times, last_request_id
+FROM expectations
+WHERE site = $1
+ORDER BY id
+`
+
+	DELETE_SITE_EXPECTATIONS_SQL = `
+DELETE FROM expectations
+WHERE site = $1
 `
 
 	INSERT_SITE_SQL = `
 INSERT INTO sites
        (site)
 VALUES ($1)
+`
+
+	GET_SITE_SETTINGS_SQL = `
+SELECT site, upstream, delay, bytes_per_second, error_rate, error_status_code, record
+FROM sites
+WHERE site = $1
+`
+
+	UPDATE_SITE_SQL = `
+UPDATE sites
+SET upstream          = $1,
+    delay             = $2,
+    bytes_per_second  = $3,
+    error_rate        = $4,
+    error_status_code = $5,
+    record            = $6
+WHERE site = $7
+`
+
+	SET_SITE_ENDPOINTS_DELAY_SQL = `
+UPDATE endpoints
+SET delay              = $1,
+    delay_distribution = 'null'
+WHERE site = $2
+`
+
+	DELETE_SITE_ENDPOINTS_SQL = `
+DELETE FROM endpoints
+WHERE site = $1
+`
+
+	DELETE_SITE_SQL = `
+DELETE FROM sites
+WHERE site = $1
 `
 
 	GET_SITE_SQL = `
@@ -56,3 +257,41 @@ FROM sites
 WHERE site = $1
 `
 )
+
+func addColumn(table, column, definition string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)
+}
+
+// MIGRATIONS are applied in order by Storage.migrate, new migrations should be appended.
+// Columns get defaults, so existing rows are read the same way as rows inserted by goslow.
+var MIGRATIONS = []string{
+	addColumn("endpoints", "path_is_regexp", "BOOLEAN DEFAULT FALSE"),
+	addColumn("endpoints", "predicates", "TEXT DEFAULT '[]'"),
+	REBUILD_ENDPOINTS_SQL,
+	addColumn("endpoints", "delay_distribution", "TEXT DEFAULT 'null'"),
+	addColumn("endpoints", "seed", "BIGINT"),
+	addColumn("endpoints", "bytes_per_second", "INT DEFAULT 0"),
+	addColumn("endpoints", "chunk_size", "INT DEFAULT 0"),
+	addColumn("endpoints", "body_delay", "BIGINT DEFAULT 0"),
+	addColumn("endpoints", "stall_delay", "BIGINT DEFAULT 0"),
+	addColumn("endpoints", "stall_offset", "INT DEFAULT 0"),
+	addColumn("endpoints", "fault", "TEXT DEFAULT ''"),
+	addColumn("endpoints", "weight", "INT DEFAULT 1"),
+	addColumn("endpoints", "variants", "TEXT DEFAULT '[]'"),
+	addColumn("endpoints", "sequence", "TEXT DEFAULT '[]'"),
+	addColumn("endpoints", "loop_sequence", "BOOLEAN DEFAULT FALSE"),
+	addColumn("endpoints", "rate_limit", "TEXT DEFAULT 'null'"),
+	addColumn("endpoints", "outage", "TEXT DEFAULT 'null'"),
+	addColumn("endpoints", "mode", "TEXT DEFAULT ''"),
+	CREATE_REQUESTS_TABLE_SQL,
+	CREATE_EXPECTATIONS_TABLE_SQL,
+	addColumn("sites", "upstream", "TEXT DEFAULT ''"),
+	addColumn("sites", "delay", "BIGINT DEFAULT 0"),
+	addColumn("sites", "bytes_per_second", "INT DEFAULT 0"),
+	addColumn("sites", "error_rate", "REAL DEFAULT 0"),
+	addColumn("sites", "error_status_code", "INT DEFAULT 0"),
+	addColumn("sites", "record", "BOOLEAN DEFAULT FALSE"),
+	CREATE_REQUESTS_INDEX_SQL,
+	addColumn("sites", "last_trimmed_request_id", "BIGINT DEFAULT 0"),
+	addColumn("expectations", "last_request_id", "BIGINT DEFAULT 0"),
+}
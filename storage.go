@@ -7,6 +7,7 @@ import (
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
@@ -22,32 +23,84 @@ type Storage struct {
 	db         *sql.DB
 }
 
-// TODO: move call to CREATE_SCHEMA_IF_NOT_EXISTS_SQL to NewServer
+// TODO: move call to Storage.migrate to NewServer
 func NewStorage(driver string, dataSource string) (*Storage, error) {
 	db, err := sql.Open(driver, dataSource)
 	if err != nil {
 		return nil, err
 	}
 	storage := &Storage{driver: driver, dataSource: dataSource, db: db}
-	_, err = storage.db.Exec(storage.dialectifySchema(CREATE_SCHEMA_IF_NOT_EXISTS_SQL))
+	err = storage.migrate()
 	return storage, err
 }
 
-// Storage.FindEndpoint returns an endpoint matching the given site and HTTP request.
+// Storage.migrate creates the schema of goslow before migrations and applies MIGRATIONS
+// that weren't applied yet. Every migration is applied in its own transaction along with the schema version.
+func (storage *Storage) migrate() error {
+	_, err := storage.db.Exec(storage.dialectifySchema(CREATE_SCHEMA_IF_NOT_EXISTS_SQL))
+	if err != nil {
+		return err
+	}
+	version, err := storage.getSchemaVersion()
+	if err != nil {
+		return err
+	}
+	for ; version < len(MIGRATIONS); version++ {
+		err = storage.applyMigration(MIGRATIONS[version], version+1)
+		if err != nil {
+			return fmt.Errorf("can't apply migration #%d: %s", version+1, err)
+		}
+	}
+	return nil
+}
+
+// Storage.getSchemaVersion returns the number of applied migrations.
+func (storage *Storage) getSchemaVersion() (int, error) {
+	var version int
+	err := storage.db.QueryRow(GET_SCHEMA_VERSION_SQL).Scan(&version)
+	if err == sql.ErrNoRows {
+		_, err = storage.db.Exec(storage.dialectifyQuery(INSERT_SCHEMA_VERSION_SQL), 0)
+		return 0, err
+	}
+	return version, err
+}
+
+func (storage *Storage) applyMigration(migration string, version int) error {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(storage.dialectifySchema(migration))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(storage.dialectifyQuery(UPDATE_SCHEMA_VERSION_SQL), version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Storage.FindEndpoint returns the most specific endpoint matching the given site and HTTP request.
 func (storage *Storage) FindEndpoint(site string, req *http.Request) (endpoint *Endpoint, found bool, err error) {
-	endpoints, err := storage.getEndpoints(site)
+	endpoints, err := storage.GetEndpoints(site)
 	if err != nil {
 		return nil, false, err
 	}
-	for _, endpoint := range endpoints {
-		if endpoint.Matches(req) {
-			return endpoint, true, nil
+	for _, candidate := range endpoints {
+		if !candidate.Matches(req) {
+			continue
+		}
+		if !found || candidate.Specificity().MoreSpecificThan(endpoint.Specificity()) {
+			endpoint, found = candidate, true
 		}
 	}
-	return nil, false, nil
+	return endpoint, found, nil
 }
 
-func (storage *Storage) getEndpoints(site string) ([]*Endpoint, error) {
+// Storage.GetEndpoints returns all endpoints of the site ordered by path, method, and predicates.
+func (storage *Storage) GetEndpoints(site string) ([]*Endpoint, error) {
 	endpoints := make([]*Endpoint, 0)
 	rows, err := storage.db.Query(storage.dialectifyQuery(GET_SITE_ENDPOINTS_SQL), site)
 	if err != nil {
@@ -65,6 +118,40 @@ func (storage *Storage) getEndpoints(site string) ([]*Endpoint, error) {
 	return endpoints, rows.Err()
 }
 
+// Storage.GetEndpoint finds the endpoint with the same site, path, method, and predicates as the given one.
+func (storage *Storage) GetEndpoint(key *Endpoint) (endpoint *Endpoint, found bool, err error) {
+	predicatesJson, err := predicatesToJson(key.Predicates)
+	if err != nil {
+		return nil, false, err
+	}
+	rows, err := storage.db.Query(storage.dialectifyQuery(GET_ENDPOINT_SQL),
+		key.Site, key.Path, key.Method, predicatesJson)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, false, rows.Err()
+	}
+	endpoint, err = makeEndpoint(rows)
+	return endpoint, err == nil, err
+}
+
+// Storage.DeleteEndpoint returns false if there was no such endpoint, see Storage.GetEndpoint.
+func (storage *Storage) DeleteEndpoint(key *Endpoint) (bool, error) {
+	predicatesJson, err := predicatesToJson(key.Predicates)
+	if err != nil {
+		return false, err
+	}
+	result, err := storage.db.Exec(storage.dialectifyQuery(DELETE_ENDPOINT_SQL),
+		key.Site, key.Path, key.Method, predicatesJson)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
 func (storage *Storage) dialectifyQuery(sql string) string {
 	if storage.isPostgres() {
 		return sql
@@ -82,43 +169,87 @@ func (storage *Storage) dialectifySchema(sql string) string {
 	}
 	// it's not pretty, but it's covered by tests
 	REPLACE_ALL := -1
+	sql = strings.Replace(sql, " SERIAL PRIMARY KEY,", " INTEGER PRIMARY KEY AUTOINCREMENT,", REPLACE_ALL)
 	return strings.Replace(sql, " BYTEA,", " BLOB,", REPLACE_ALL)
 }
 
 func makeEndpoint(rows *sql.Rows) (*Endpoint, error) {
 	endpoint := &Endpoint{}
-	var headersJson string
-	var delay int64
-	err := rows.Scan(&endpoint.Site, &endpoint.Path, &endpoint.Method, &headersJson, &delay,
-		&endpoint.StatusCode, &endpoint.Response)
+	var predicatesJson, headersJson, delayDistributionJson, variantsJson, sequenceJson, rateLimitJson, outageJson string
+	var delay, bodyDelay, stallDelay int64
+	var seed sql.NullInt64
+	err := rows.Scan(&endpoint.Site, &endpoint.Path, &endpoint.PathIsRegexp, &endpoint.Method,
+		&predicatesJson, &headersJson, &delay, &delayDistributionJson, &seed,
+		&endpoint.StatusCode, &endpoint.Response, &endpoint.BytesPerSecond, &endpoint.ChunkSize,
+		&bodyDelay, &stallDelay, &endpoint.StallOffset, &endpoint.Fault, &endpoint.Weight, &variantsJson,
+		&sequenceJson, &endpoint.Loop, &rateLimitJson, &outageJson, &endpoint.Mode)
 	if err != nil {
 		return endpoint, err
 	}
 	endpoint.Delay = time.Duration(delay)
-	endpoint.Headers, err = jsonToStringMap(headersJson)
+	endpoint.BodyDelay = time.Duration(bodyDelay)
+	endpoint.StallDelay = time.Duration(stallDelay)
+	if seed.Valid {
+		endpoint.Seed = &seed.Int64
+	}
+	err = json.Unmarshal([]byte(predicatesJson), &endpoint.Predicates)
+	if err != nil {
+		return endpoint, err
+	}
+	err = json.Unmarshal([]byte(delayDistributionJson), &endpoint.DelayDistribution)
+	if err != nil {
+		return endpoint, err
+	}
+	err = json.Unmarshal([]byte(variantsJson), &endpoint.Variants)
+	if err != nil {
+		return endpoint, err
+	}
+	err = json.Unmarshal([]byte(sequenceJson), &endpoint.Sequence)
+	if err != nil {
+		return endpoint, err
+	}
+	err = json.Unmarshal([]byte(rateLimitJson), &endpoint.RateLimit)
+	if err != nil {
+		return endpoint, err
+	}
+	err = json.Unmarshal([]byte(outageJson), &endpoint.Outage)
+	if err != nil {
+		return endpoint, err
+	}
+	endpoint.Headers, err = jsonToHeaders(headersJson)
 	return endpoint, err
 }
 
-func jsonToStringMap(js string) (map[string]string, error) {
+// jsonToHeaders accepts both {"Name": ["value1", "value2"]} and
+// {"Name": "value"} (headers were single-valued in the older versions).
+func jsonToHeaders(js string) (http.Header, error) {
 	object := make(map[string]interface{})
 	err := json.Unmarshal([]byte(js), &object)
 	if err != nil {
 		return nil, err
 	}
-	return objectToStringMap(object)
+	return objectToHeaders(object)
 }
 
-func objectToStringMap(object map[string]interface{}) (map[string]string, error) {
-	m := make(map[string]string)
+func objectToHeaders(object map[string]interface{}) (http.Header, error) {
+	headers := make(http.Header)
 	for key, value := range object {
 		switch value.(type) {
 		case string:
-			m[key] = value.(string)
+			headers[key] = []string{value.(string)}
+		case []interface{}:
+			for _, item := range value.([]interface{}) {
+				s, isString := item.(string)
+				if !isString {
+					return nil, fmt.Errorf("Expecting string, got %+v", item)
+				}
+				headers[key] = append(headers[key], s)
+			}
 		default:
-			return nil, fmt.Errorf("Expecting string, got %+v", value)
+			return nil, fmt.Errorf("Expecting string or list of strings, got %+v", value)
 		}
 	}
-	return m, nil
+	return headers, nil
 }
 
 // Storage.SaveEndpoint upserts the given endpoint into a database.
@@ -130,30 +261,271 @@ func (storage *Storage) SaveEndpoint(endpoint *Endpoint) error {
 	// If tx is commited, then tx.Rollback() basically has no effect.
 	// If there's some error and tx isn't commited, then we want to rollback.
 	defer tx.Rollback()
+	err = storage.saveEndpointTx(tx, endpoint)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Storage.ImportEndpoints saves endpoints to the site in a single transaction, the site is created if needed.
+// If replace is true, then other endpoints of the site are deleted.
+func (storage *Storage) ImportEndpoints(site string, endpoints []*Endpoint, replace bool) error {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(storage.dialectifyQuery(GET_SITE_SQL), site)
+	if err != nil {
+		return err
+	}
+	siteExists := rows.Next()
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	if !siteExists {
+		_, err = tx.Exec(storage.dialectifyQuery(INSERT_SITE_SQL), site)
+		if err != nil {
+			return err
+		}
+	}
+	if replace {
+		_, err = tx.Exec(storage.dialectifyQuery(DELETE_SITE_ENDPOINTS_SQL), site)
+		if err != nil {
+			return err
+		}
+	}
+	for _, endpoint := range endpoints {
+		err = storage.saveEndpointTx(tx, endpoint)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (storage *Storage) saveEndpointTx(tx *sql.Tx, endpoint *Endpoint) error {
 	// upsert as delete-and-insert isn't correct in all cases
 	// (e.g concurrent upserts of the same endpoint will lead to "duplicate key value violates unique constraint")
 	// but is practical enough, because concurrent upserts of the same endpoint are going to be extremely rare
+	predicatesJson, err := predicatesToJson(endpoint.Predicates)
+	if err != nil {
+		return err
+	}
 	_, err = tx.Exec(storage.dialectifyQuery(DELETE_ENDPOINT_SQL),
-		endpoint.Site, endpoint.Path, endpoint.Method)
+		endpoint.Site, endpoint.Path, endpoint.Method, predicatesJson)
+	if err != nil {
+		return err
+	}
+	headersJson, err := headersToJson(endpoint.Headers)
+	if err != nil {
+		return err
+	}
+	delayDistributionJson, err := json.Marshal(endpoint.DelayDistribution)
+	if err != nil {
+		return err
+	}
+	variantsJson, err := json.Marshal(endpoint.Variants)
+	if err != nil {
+		return err
+	}
+	sequenceJson, err := json.Marshal(endpoint.Sequence)
+	if err != nil {
+		return err
+	}
+	rateLimitJson, err := json.Marshal(endpoint.RateLimit)
 	if err != nil {
 		return err
 	}
-	headersJson, err := stringMapToJson(endpoint.Headers)
+	outageJson, err := json.Marshal(endpoint.Outage)
 	if err != nil {
 		return err
 	}
 	_, err = tx.Exec(storage.dialectifyQuery(INSERT_ENDPOINT_SQL),
-		endpoint.Site, endpoint.Path, endpoint.Method,
-		headersJson, int64(endpoint.Delay), endpoint.StatusCode, endpoint.Response)
+		endpoint.Site, endpoint.Path, endpoint.PathIsRegexp, endpoint.Method, predicatesJson,
+		headersJson, int64(endpoint.Delay), string(delayDistributionJson), nullableInt64(endpoint.Seed),
+		endpoint.StatusCode, endpoint.Response, endpoint.BytesPerSecond, endpoint.ChunkSize,
+		int64(endpoint.BodyDelay), int64(endpoint.StallDelay), endpoint.StallOffset, endpoint.Fault,
+		endpoint.Weight, string(variantsJson), string(sequenceJson), endpoint.Loop,
+		string(rateLimitJson), string(outageJson), endpoint.Mode)
+	return err
+}
+
+func nullableInt64(i *int64) sql.NullInt64 {
+	if i == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *i, Valid: true}
+}
+
+// predicatesToJson returns "[]" for no predicates, because predicates are a part of the primary key.
+func predicatesToJson(predicates []*Predicate) (string, error) {
+	if predicates == nil {
+		predicates = []*Predicate{}
+	}
+	jsonBytes, err := json.Marshal(predicates)
+	return string(jsonBytes), err
+}
+
+func headersToJson(headers http.Header) (string, error) {
+	if headers == nil {
+		headers = EMPTY_HEADERS
+	}
+	jsonBytes, err := json.Marshal(headers)
+	return string(jsonBytes), err
+}
+
+// Storage.LogRequest saves the request and forgets the oldest requests of the site,
+// so there are at most maxRequests requests per site.
+func (storage *Storage) LogRequest(request *LoggedRequest, maxRequests int) error {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	headersJson, err := headersToJson(request.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(storage.dialectifyQuery(INSERT_REQUEST_SQL),
+		request.Site, request.Method, request.Path, request.Query.Encode(), headersJson, []byte(request.Body),
+		request.Endpoint, int64(request.Delay), request.Time.UnixNano())
+	if err != nil {
+		return err
+	}
+	var lastTrimmedId int64
+	err = tx.QueryRow(storage.dialectifyQuery(GET_LAST_TRIMMED_REQUEST_ID_SQL), request.Site, maxRequests).
+		Scan(&lastTrimmedId)
+	if err == sql.ErrNoRows {
+		return tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(storage.dialectifyQuery(TRIM_REQUESTS_SQL), request.Site, lastTrimmedId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(storage.dialectifyQuery(SET_LAST_TRIMMED_REQUEST_ID_SQL), lastTrimmedId, request.Site)
 	if err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-func stringMapToJson(m map[string]string) (string, error) {
-	jsonBytes, err := json.Marshal(m)
-	return string(jsonBytes), err
+// Storage.GetLastTrimmedRequestId returns the id of the latest request forgotten by LogRequest,
+// or 0 if the site hasn't lost requests since ClearRequests.
+func (storage *Storage) GetLastTrimmedRequestId(site string) (int64, error) {
+	var lastTrimmedId int64
+	err := storage.db.QueryRow(storage.dialectifyQuery(GET_LAST_TRIMMED_REQUEST_ID_OF_SITE_SQL), site).
+		Scan(&lastTrimmedId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return lastTrimmedId, err
+}
+
+// Storage.GetRequests returns the logged requests of the site, oldest first.
+func (storage *Storage) GetRequests(site string) ([]*LoggedRequest, error) {
+	requests := make([]*LoggedRequest, 0)
+	rows, err := storage.db.Query(storage.dialectifyQuery(GET_SITE_REQUESTS_SQL), site)
+	if err != nil {
+		return requests, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		request, err := makeLoggedRequest(rows)
+		if err != nil {
+			return requests, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+func makeLoggedRequest(rows *sql.Rows) (*LoggedRequest, error) {
+	request := &LoggedRequest{}
+	var rawQuery, headersJson string
+	var body []byte
+	var delay, receivedAt int64
+	err := rows.Scan(&request.Id, &request.Site, &request.Method, &request.Path, &rawQuery, &headersJson,
+		&body, &request.Endpoint, &delay, &receivedAt)
+	if err != nil {
+		return request, err
+	}
+	request.Body = string(body)
+	request.Delay = time.Duration(delay)
+	request.Time = time.Unix(0, receivedAt)
+	request.Query, err = url.ParseQuery(rawQuery)
+	if err != nil {
+		return request, err
+	}
+	request.Headers, err = jsonToHeaders(headersJson)
+	return request, err
+}
+
+func (storage *Storage) ClearRequests(site string) error {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(storage.dialectifyQuery(DELETE_SITE_REQUESTS_SQL), site)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(storage.dialectifyQuery(SET_LAST_TRIMMED_REQUEST_ID_SQL), 0, site)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (storage *Storage) SaveExpectation(expectation *Expectation) error {
+	predicatesJson, err := predicatesToJson(expectation.Predicates)
+	if err != nil {
+		return err
+	}
+	_, err = storage.db.Exec(storage.dialectifyQuery(INSERT_EXPECTATION_SQL),
+		expectation.Site, expectation.Path, expectation.PathIsRegexp, expectation.Method, predicatesJson,
+		expectation.MinTimes, expectation.MaxTimes)
+	return err
+}
+
+// Storage.GetExpectations returns the expectations of the site in the order they were added.
+func (storage *Storage) GetExpectations(site string) ([]*Expectation, error) {
+	expectations := make([]*Expectation, 0)
+	rows, err := storage.db.Query(storage.dialectifyQuery(GET_SITE_EXPECTATIONS_SQL), site)
+	if err != nil {
+		return expectations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		expectation := &Expectation{}
+		var predicatesJson string
+		err := rows.Scan(&expectation.Id, &expectation.Site, &expectation.Path, &expectation.PathIsRegexp,
+			&expectation.Method, &predicatesJson, &expectation.MinTimes, &expectation.MaxTimes,
+			&expectation.LastRequestId)
+		if err != nil {
+			return expectations, err
+		}
+		err = json.Unmarshal([]byte(predicatesJson), &expectation.Predicates)
+		if err != nil {
+			return expectations, err
+		}
+		expectations = append(expectations, expectation)
+	}
+	return expectations, rows.Err()
+}
+
+func (storage *Storage) ClearExpectations(site string) error {
+	_, err := storage.db.Exec(storage.dialectifyQuery(DELETE_SITE_EXPECTATIONS_SQL), site)
+	return err
 }
 
 // Storage.CreateSite returns an error if the given site already exists in a database.
@@ -162,6 +534,63 @@ func (storage *Storage) CreateSite(site string) error {
 	return err
 }
 
+// Storage.GetSite returns the settings of the given site.
+func (storage *Storage) GetSite(name string) (site *Site, found bool, err error) {
+	rows, err := storage.db.Query(storage.dialectifyQuery(GET_SITE_SETTINGS_SQL), name)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, false, rows.Err()
+	}
+	site = &Site{}
+	var delay int64
+	err = rows.Scan(&site.Name, &site.Upstream, &delay, &site.BytesPerSecond, &site.ErrorRate, &site.ErrorStatusCode,
+		&site.Record)
+	if err != nil {
+		return nil, false, err
+	}
+	site.Delay = time.Duration(delay)
+	return site, true, nil
+}
+
+// Storage.SaveSite updates the settings of the existing site.
+func (storage *Storage) SaveSite(site *Site) error {
+	_, err := storage.db.Exec(storage.dialectifyQuery(UPDATE_SITE_SQL),
+		site.Upstream, int64(site.Delay), site.BytesPerSecond, site.ErrorRate, site.ErrorStatusCode, site.Record,
+		site.Name)
+	return err
+}
+
+// Storage.SetEndpointsDelay sets the same fixed delay for all endpoints of the site.
+func (storage *Storage) SetEndpointsDelay(site string, delay time.Duration) error {
+	_, err := storage.db.Exec(storage.dialectifyQuery(SET_SITE_ENDPOINTS_DELAY_SQL), int64(delay), site)
+	return err
+}
+
+func (storage *Storage) ClearEndpoints(site string) error {
+	_, err := storage.db.Exec(storage.dialectifyQuery(DELETE_SITE_ENDPOINTS_SQL), site)
+	return err
+}
+
+// Storage.DeleteSite deletes the site with its endpoints, logged requests, and expectations.
+func (storage *Storage) DeleteSite(site string) error {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{DELETE_SITE_ENDPOINTS_SQL, DELETE_SITE_REQUESTS_SQL,
+		DELETE_SITE_EXPECTATIONS_SQL, DELETE_SITE_SQL} {
+		_, err = tx.Exec(storage.dialectifyQuery(query), site)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (storage *Storage) SiteExists(site string) (bool, error) {
 	return storage.HasResults(GET_SITE_SQL, site)
 }
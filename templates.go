@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"text/template"
 	"time"
 )
@@ -9,7 +10,28 @@ type TemplateData struct {
 	Site              string // e.g k38skjdf
 	Path              string
 	Method            string
+	StatusCode        int
 	Delay             time.Duration
+	DelayDistribution *DelayDistribution
+	Predicates        []*Predicate
+	Headers           http.Header
+	BytesPerSecond    int
+	BodyDelay         time.Duration
+	StallDelay        time.Duration
+	StallOffset       int
+	Fault             string
+	Weight            int
+	Variants          []*Variant
+	Sequence          []*Variant
+	Loop              bool
+	RateLimit         *RateLimit
+	Outage            *OutageSchedule
+	Mode              string
+	Upstream          string
+	ErrorRate         float64
+	ErrorStatusCode   int
+	Record            bool
+	Count             int // e.g of imported endpoints
 	TruncatedResponse string
 	CreateDomain      string // e.g create.goslow.link
 	Domain            string // e.g k38skjdf.goslow.link
@@ -53,9 +75,77 @@ You can configure it with the POST requests to {{ .AdminDomain }}
 	ENDPOINT_ADDED_TEMPLATE = makeTemplate("endpoint added",
 		"Hooray!\n"+
 			"Endpoint http://{{ .Domain }}{{ .Path }} responds to {{ or .Method \"any HTTP Method\"}} "+
-			"{{ if .Delay }}with {{ .Delay }} delay{{ else }}without any delay{{end}}.\n"+
+			"{{ if .DelayDistribution }}with {{ .DelayDistribution }} delay"+
+			"{{ else if .Delay }}with {{ .Delay }} delay{{ else }}without any delay{{end}}.\n"+
+			"{{ range .Predicates }}Only requests with {{ . }}.\n{{ end }}"+
+			"{{ range $name, $values := .Headers }}{{ range $values }}Header {{ $name }}: {{ . }}\n{{ end }}{{ end }}"+
+			"{{ if .Fault }}Instead of responding the connection fails with {{ .Fault }}.\n{{ end }}"+
+			"{{ if .BodyDelay }}Body is sent {{ .BodyDelay }} after headers.\n{{ end }}"+
+			"{{ if .StallDelay }}Body stalls for {{ .StallDelay }} after {{ .StallOffset }} bytes.\n{{ end }}"+
+			"{{ if .Outage }}{{ range .Outage.Windows }}Outage {{ . }}.\n{{ end }}"+
+			"During outages response is {{ .Outage.Response }}.\n{{ end }}"+
+			"{{ if .RateLimit }}Rate limit is {{ .RateLimit }}, then it's 429.\n{{ end }}"+
+			"{{ if .BytesPerSecond }}Response trickles at {{ .BytesPerSecond }} bytes per second.\n{{ end }}"+
+			"Response is: {{ or .TruncatedResponse \"<EMPTY>\"}}\n"+
+			"{{ if .Mode }}Response mode is {{ .Mode }}.\n{{ end }}"+
+			"{{ if .Variants }}Response above has weight {{ .Weight }}. Other responses:\n"+
+			"{{ range .Variants }}{{ . }}\n{{ end }}{{ end }}"+
+			"{{ if .Sequence }}First responses are:\n{{ range .Sequence }}{{ . }}\n{{ end }}"+
+			"{{ if .Loop }}And then the sequence starts over.{{ else }}And then it's the response above.{{ end }}\n{{ end }}")
+
+	SITE_ENDPOINTS_TEMPLATE = makeTemplate("site endpoints",
+		"Endpoints of http://{{ .Domain }}:\n")
+
+	NO_ENDPOINTS_TEMPLATE = makeTemplate("no endpoints",
+		"Site http://{{ .Domain }} has no endpoints yet.\n"+
+			"You can add them with the POST requests to {{ .AdminDomain }}{{ .AdminPathPrefix }}\n")
+
+	ENDPOINT_SUMMARY_TEMPLATE = makeTemplate("endpoint summary",
+		"\n{{ or .Method \"ANY\" }} {{ .Path }} responds with {{ .StatusCode }} "+
+			"{{ if .DelayDistribution }}after {{ .DelayDistribution }} delay"+
+			"{{ else if .Delay }}after {{ .Delay }} delay{{ else }}without any delay{{ end }}.\n"+
+			"{{ range .Predicates }}Only requests with {{ . }}.\n{{ end }}"+
+			"{{ range $name, $values := .Headers }}{{ range $values }}Header {{ $name }}: {{ . }}\n{{ end }}{{ end }}"+
 			"Response is: {{ or .TruncatedResponse \"<EMPTY>\"}}\n")
 
+	BUNDLE_IMPORTED_TEMPLATE = makeTemplate("bundle imported",
+		"Hooray!\n{{ .Count }} endpoints are imported to http://{{ .Domain }}\n")
+
+	REQUESTS_CLEARED_TEMPLATE = makeTemplate("requests cleared",
+		"Logged requests to http://{{ .Domain }} are forgotten.\n")
+
+	PROXY_CONFIGURED_TEMPLATE = makeTemplate("proxy configured",
+		"{{ if .Upstream }}Hooray!\n"+
+			"Unknown paths of http://{{ .Domain }} are proxied to {{ .Upstream }} "+
+			"{{ if .Delay }}with {{ .Delay }} delay{{ else }}without any delay{{ end }}.\n"+
+			"{{ if .BytesPerSecond }}Responses trickle at {{ .BytesPerSecond }} bytes per second.\n{{ end }}"+
+			"{{ if .ErrorRate }}{{ .ErrorRate }} of requests fail with {{ .ErrorStatusCode }}.\n{{ end }}"+
+			"{{ if .Record }}Upstream responses are recorded as endpoints.\n{{ end }}"+
+			"{{ else }}Unknown paths of http://{{ .Domain }} are not proxied anymore.\n{{ end }}")
+
+	REPLAY_TEMPLATE = makeTemplate("replay",
+		"Site http://{{ .Domain }} is not proxied anymore, only its endpoints respond"+
+			"{{ if .Delay }} with {{ .Delay }} delay{{ end }}.\n")
+
+	EXPECTATION_ADDED_TEMPLATE = makeTemplate("expectation added",
+		"Hooray!\nExpecting {{ . }}.\n")
+
+	EXPECTATIONS_CLEARED_TEMPLATE = makeTemplate("expectations cleared",
+		"Expectations of http://{{ .Domain }} are forgotten.\n")
+
+	ENDPOINT_DELETED_TEMPLATE = makeTemplate("endpoint deleted",
+		"Endpoint http://{{ .Domain }}{{ .Path }} responding to {{ or .Method \"any HTTP Method\"}} is deleted.\n"+
+			"{{ range .Predicates }}It was only for requests with {{ . }}.\n{{ end }}")
+
+	ENDPOINTS_CLEARED_TEMPLATE = makeTemplate("endpoints cleared",
+		"All endpoints of http://{{ .Domain }} are deleted.\n")
+
+	SITE_DELETED_TEMPLATE = makeTemplate("site deleted",
+		"Site http://{{ .Domain }} is deleted with all its endpoints, logged requests, and expectations.\n")
+
+	SEQUENCE_RESET_TEMPLATE = makeTemplate("sequence reset",
+		"Sequence of the endpoint http://{{ .Domain }}{{ .Path }} starts over.\n")
+
 	UNKNOWN_ENDPOINT_TEMPLATE = makeTemplate("unknown endpoint",
 		`Oopsie daisy!
 Endpoint http://{{ .Domain }}{{ .Path }} isn't configured yet.
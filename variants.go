@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_WEIGHT    = 1
+	VARIANT_SEPARATOR = ";"
+	VARIANT_BODY_KEY  = "body" // body goes last and takes the rest of the variant, so it can contain ';'
+)
+
+// Variant is an alternative response of an endpoint.
+// Endpoint itself responds with the probability Endpoint.Weight / (sum of all weights),
+// each variant responds with the probability Variant.Weight / (sum of all weights).
+// Variants are also used as steps of the endpoint sequence, Weight is ignored there.
+// If Fault is not empty, then the variant breaks the connection instead of responding.
+type Variant struct {
+	Weight     int
+	StatusCode int
+	Delay      time.Duration
+	Headers    http.Header `json:",omitempty"`
+	Response   []byte
+	Fault      string `json:",omitempty"`
+}
+
+// parseVariant parses weight=WEIGHT;status=STATUS;delay=DELAY;header=NAME:VALUE;fault=FAULT;body=BODY
+// All keys are optional, header can be repeated, body should be the last.
+func parseVariant(rawVariant string) (*Variant, error) {
+	variant := &Variant{Weight: DEFAULT_WEIGHT, StatusCode: DEFAULT_STATUS_CODE, Headers: make(http.Header)}
+	rest := rawVariant
+	for rest != "" {
+		var part string
+		if strings.HasPrefix(rest, VARIANT_BODY_KEY+"=") {
+			part, rest = rest, ""
+		} else {
+			parts := strings.SplitN(rest, VARIANT_SEPARATOR, 2)
+			part, rest = parts[0], ""
+			if len(parts) == 2 {
+				rest = parts[1]
+			}
+		}
+		err := variant.set(part)
+		if err != nil {
+			return nil, InvalidVariantError(rawVariant, err.Error())
+		}
+	}
+	return variant, nil
+}
+
+func (variant *Variant) set(part string) error {
+	keyValue := strings.SplitN(part, "=", 2)
+	if len(keyValue) != 2 {
+		return fmt.Errorf("expecting KEY=VALUE, got <%s>", part)
+	}
+	key, value := keyValue[0], keyValue[1]
+	var err error
+	switch key {
+	case "weight":
+		variant.Weight, err = strconv.Atoi(value)
+		if err == nil && variant.Weight < 0 {
+			err = fmt.Errorf("weight can't be negative")
+		}
+	case "status":
+		variant.StatusCode, err = strconv.Atoi(value)
+	case "delay":
+		variant.Delay, err = parseDelayValue(value)
+	case "header":
+		nameValue := strings.SplitN(value, HEADER_SEPARATOR, 2)
+		if len(nameValue) != 2 {
+			return fmt.Errorf("expecting header=NAME:VALUE, got <%s>", part)
+		}
+		variant.Headers.Add(strings.TrimSpace(nameValue[0]), strings.TrimSpace(nameValue[1]))
+	case "fault":
+		if !isFault(value) {
+			return fmt.Errorf("unknown fault <%s>", value)
+		}
+		variant.Fault = value
+	case VARIANT_BODY_KEY:
+		variant.Response = []byte(value)
+	default:
+		return fmt.Errorf("unknown key <%s>", key)
+	}
+	return err
+}
+
+func (variant *Variant) String() string {
+	return fmt.Sprintf("status %d with %s delay and weight %d", variant.StatusCode, variant.Delay, variant.Weight)
+}
+
+// Endpoint.ChooseVariant returns the endpoint itself or the endpoint with the response
+// of one of its variants according to their weights.
+func (endpoint *Endpoint) ChooseVariant(random Random) *Endpoint {
+	if len(endpoint.Variants) == 0 {
+		return endpoint
+	}
+	totalWeight := endpoint.Weight
+	for _, variant := range endpoint.Variants {
+		totalWeight += variant.Weight
+	}
+	if totalWeight <= 0 {
+		return endpoint
+	}
+	choice := int(random.Float64() * float64(totalWeight))
+	if choice < endpoint.Weight {
+		return endpoint
+	}
+	choice -= endpoint.Weight
+	for _, variant := range endpoint.Variants {
+		if choice < variant.Weight {
+			return endpoint.withVariant(variant)
+		}
+		choice -= variant.Weight
+	}
+	return endpoint
+}
+
+// Endpoint.ChooseStep returns the endpoint with the response of the step number i of its sequence.
+// Endpoint itself is the last step. After the last step the sequence starts over if Loop is true,
+// otherwise the endpoint keeps responding as the last step.
+func (endpoint *Endpoint) ChooseStep(i int) *Endpoint {
+	if len(endpoint.Sequence) == 0 {
+		return endpoint
+	}
+	if endpoint.Loop {
+		i %= len(endpoint.Sequence) + 1
+	}
+	if i >= len(endpoint.Sequence) {
+		return endpoint
+	}
+	return endpoint.withVariant(endpoint.Sequence[i])
+}
+
+// Endpoint.withVariant returns a copy of the endpoint responding like the variant.
+// Response settings that the variant doesn't have are reset, so the variant isn't trickled, stalled,
+// broken by the fault, or rendered as a template just because the endpoint is.
+func (endpoint *Endpoint) withVariant(variant *Variant) *Endpoint {
+	copy := *endpoint
+	copy.StatusCode = variant.StatusCode
+	copy.Delay = variant.Delay
+	copy.DelayDistribution = nil
+	copy.Headers = variant.Headers
+	copy.Response = variant.Response
+	copy.Fault = variant.Fault
+	copy.BytesPerSecond = 0
+	copy.ChunkSize = 0
+	copy.BodyDelay = 0
+	copy.StallDelay = 0
+	copy.StallOffset = len(variant.Response) / 2 // same as getStallOffset, fault=truncate sends half of the response
+	copy.Mode = STATIC_MODE
+	return &copy
+}